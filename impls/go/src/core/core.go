@@ -20,27 +20,57 @@ func throw(a []MalType) (MalType, error) {
 	return nil, MalError{a[0]}
 }
 
+func ex_info(a []MalType) (MalType, error) {
+	ex := &ExInfo{Message: string(a[0].(String)), Data: HashMap{}}
+	if a[1] != nil {
+		ex.Data = a[1].(HashMap)
+	}
+	if len(a) == 3 {
+		ex.Cause = a[2]
+	}
+	return ex, nil
+}
+
+func ex_message(a []MalType) (MalType, error) {
+	if ex, ok := a[0].(*ExInfo); ok {
+		return String(ex.Message), nil
+	}
+	return nil, nil
+}
+
+func ex_data(a []MalType) (MalType, error) {
+	if ex, ok := a[0].(*ExInfo); ok {
+		return ex.Data, nil
+	}
+	return nil, nil
+}
+
+func ex_cause(a []MalType) (MalType, error) {
+	if ex, ok := a[0].(*ExInfo); ok {
+		return ex.Cause, nil
+	}
+	return nil, nil
+}
+
 func fn_q(a []MalType) (MalType, error) {
 	switch f := a[0].(type) {
-	case MalFunc:
-		return !f.GetMacro(), nil
-	case Func:
-		return true, nil
-	case func([]MalType) (MalType, error):
-		return true, nil
+	case *MalFunc:
+		return Bool(!f.GetMacro()), nil
+	case *Func:
+		return Bool(true), nil
 	default:
-		return false, nil
+		return Bool(false), nil
 	}
 }
 
 // String functions
 
 func pr_str(a []MalType) (MalType, error) {
-	return printer.Pr_list(a, true, "", "", " "), nil
+	return String(printer.Pr_list(a, true, "", "", " ")), nil
 }
 
 func str(a []MalType) (MalType, error) {
-	return printer.Pr_list(a, false, "", "", ""), nil
+	return String(printer.Pr_list(a, false, "", "", "")), nil
 }
 
 func prn(a []MalType) (MalType, error) {
@@ -54,237 +84,640 @@ func println(a []MalType) (MalType, error) {
 }
 
 func slurp(a []MalType) (MalType, error) {
-	b, e := ioutil.ReadFile(a[0].(string))
+	b, e := ioutil.ReadFile(string(a[0].(String)))
 	if e != nil {
 		return nil, e
 	}
-	return string(b), nil
+	return String(b), nil
 }
 
-// Number functions
-func time_ms(a []MalType) (MalType, error) {
-	return int(time.Now().UnixNano() / int64(time.Millisecond)), nil
+func do_readline(a []MalType) (MalType, error) {
+	line, e := readline.Readline(string(a[0].(String)))
+	if e != nil {
+		return nil, e
+	}
+	return String(line), nil
 }
 
-// Hash Map functions
-func copy_hash_map(hm HashMap) HashMap {
-	new_hm := HashMap{map[string]MalType{}, nil}
-	for k, v := range hm.Val {
-		new_hm.Val[k] = v
+// Regular expression functions
+
+func to_regex(name string, obj MalType) (Regex, error) {
+	switch re := obj.(type) {
+	case Regex:
+		return re, nil
+	case String:
+		r, e := NewRegex(string(re))
+		if e != nil {
+			return Regex{}, e
+		}
+		return r.(Regex), nil
 	}
-	return new_hm
+	return Regex{}, errors.New(name + " called with non-regex pattern")
 }
 
-func assoc(a []MalType) (MalType, error) {
-	if len(a) < 3 {
-		return nil, errors.New("assoc requires at least 3 arguments")
+// re_result turns submatch indexes into the value returned by re-find
+// and re-seq: the matched string when the pattern has no groups,
+// otherwise a vector of the match followed by each group (nil when a
+// group did not participate in the match)
+func re_result(s string, loc []int) MalType {
+	if len(loc) == 2 {
+		return String(s[loc[0]:loc[1]])
 	}
-	if len(a)%2 != 1 {
-		return nil, errors.New("assoc requires odd number of arguments")
+	groups := make([]MalType, 0, len(loc)/2)
+	for i := 0; i < len(loc); i += 2 {
+		if loc[i] < 0 {
+			groups = append(groups, nil)
+		} else {
+			groups = append(groups, String(s[loc[i]:loc[i+1]]))
+		}
 	}
-	if !HashMap_Q(a[0]) {
-		return nil, errors.New("assoc called on non-hash map")
+	return Vector{groups, nil}
+}
+
+func re_args(name string, a []MalType) (Regex, string, error) {
+	re, e := to_regex(name, a[0])
+	if e != nil {
+		return Regex{}, "", e
 	}
-	new_hm := copy_hash_map(a[0].(HashMap))
-	for i := 1; i < len(a); i += 2 {
-		key := a[i]
-		if !String_Q(key) {
-			return nil, errors.New("assoc called with non-string key")
-		}
-		new_hm.Val[key.(string)] = a[i+1]
+	s, ok := a[1].(String)
+	if !ok {
+		return Regex{}, "", errors.New(name + " called with non-string")
 	}
-	return new_hm, nil
+	return re, string(s), nil
 }
 
-func dissoc(a []MalType) (MalType, error) {
-	if len(a) < 2 {
-		return nil, errors.New("dissoc requires at least 3 arguments")
+func re_pattern(a []MalType) (MalType, error) {
+	return to_regex("re-pattern", a[0])
+}
+
+func re_find(a []MalType) (MalType, error) {
+	re, s, e := re_args("re-find", a)
+	if e != nil {
+		return nil, e
 	}
-	if !HashMap_Q(a[0]) {
-		return nil, errors.New("dissoc called on non-hash map")
+	loc := re.Val.FindStringSubmatchIndex(s)
+	if loc == nil {
+		return nil, nil
 	}
-	new_hm := copy_hash_map(a[0].(HashMap))
-	for i := 1; i < len(a); i += 1 {
-		key := a[i]
-		if !String_Q(key) {
-			return nil, errors.New("dissoc called with non-string key")
-		}
-		delete(new_hm.Val, key.(string))
+	return re_result(s, loc), nil
+}
+
+func re_matches(a []MalType) (MalType, error) {
+	re, s, e := re_args("re-matches", a)
+	if e != nil {
+		return nil, e
 	}
-	return new_hm, nil
+	loc := re.Anchored.FindStringSubmatchIndex(s)
+	if loc == nil {
+		return nil, nil
+	}
+	return re_result(s, loc), nil
 }
 
-func get(a []MalType) (MalType, error) {
-	if Nil_Q(a[0]) {
+func re_seq(a []MalType) (MalType, error) {
+	re, s, e := re_args("re-seq", a)
+	if e != nil {
+		return nil, e
+	}
+	locs := re.Val.FindAllStringSubmatchIndex(s, -1)
+	if len(locs) == 0 {
+		return nil, nil
+	}
+	matches := make([]MalType, 0, len(locs))
+	for _, loc := range locs {
+		matches = append(matches, re_result(s, loc))
+	}
+	return List{Val: matches}, nil
+}
+
+// re-groups returns the named groups of the first match as a map from
+// keyword to matched string
+func re_groups(a []MalType) (MalType, error) {
+	re, s, e := re_args("re-groups", a)
+	if e != nil {
+		return nil, e
+	}
+	loc := re.Val.FindStringSubmatchIndex(s)
+	if loc == nil {
 		return nil, nil
 	}
-	if !HashMap_Q(a[0]) {
-		return nil, errors.New("get called on non-hash map")
+	groups := []MalType{}
+	for i, name := range re.Val.SubexpNames() {
+		if name == "" {
+			continue
+		}
+		if loc[2*i] < 0 {
+			groups = append(groups, Keyword(name), nil)
+		} else {
+			groups = append(groups, Keyword(name), String(s[loc[2*i]:loc[2*i+1]]))
+		}
+	}
+	return HashMap{}.AssocAll(groups...), nil
+}
+
+// replace substitutes every occurrence of a string or regex. With a
+// regex the replacement may use $1/${name} group references or be a
+// function called with the same value re-find would return.
+func replace(a []MalType) (MalType, error) {
+	s, ok := a[0].(String)
+	if !ok {
+		return nil, errors.New("replace called with non-string")
 	}
-	if !String_Q(a[1]) {
-		return nil, errors.New("get called with non-string key")
+	switch match := a[1].(type) {
+	case String:
+		repl, ok := a[2].(String)
+		if !ok {
+			return nil, errors.New("replace with a string match requires a string replacement")
+		}
+		return String(strings.Replace(string(s), string(match), string(repl), -1)), nil
+	case Regex:
+		if repl, ok := a[2].(String); ok {
+			return String(match.Val.ReplaceAllString(string(s), string(repl))), nil
+		}
+		var sb strings.Builder
+		last := 0
+		for _, loc := range match.Val.FindAllStringSubmatchIndex(string(s), -1) {
+			res, e := Apply(a[2], []MalType{re_result(string(s), loc)})
+			if e != nil {
+				return nil, e
+			}
+			sb.WriteString(string(s[last:loc[0]]))
+			sb.WriteString(printer.Pr_str(res, false))
+			last = loc[1]
+		}
+		sb.WriteString(string(s[last:]))
+		return String(sb.String()), nil
+	default:
+		return nil, errors.New("replace called with non-string, non-regex match")
 	}
-	return a[0].(HashMap).Val[a[1].(string)], nil
 }
 
-func contains_Q(hm MalType, key MalType) (MalType, error) {
-	if Nil_Q(hm) {
-		return false, nil
+// split breaks a string on a string or regex separator into a vector.
+// Without a limit trailing empty strings are dropped.
+func split(a []MalType) (MalType, error) {
+	s, ok := a[0].(String)
+	if !ok {
+		return nil, errors.New("split called with non-string")
 	}
-	if !HashMap_Q(hm) {
-		return nil, errors.New("get called on non-hash map")
+	limit := -1
+	if len(a) == 3 {
+		n, ok := a[2].(Int)
+		if !ok {
+			return nil, errors.New("split called with non-integer limit")
+		}
+		limit = int(n)
 	}
-	if !String_Q(key) {
-		return nil, errors.New("get called with non-string key")
+	var parts []string
+	switch sep := a[1].(type) {
+	case String:
+		parts = strings.SplitN(string(s), string(sep), limit)
+	case Regex:
+		parts = sep.Val.Split(string(s), limit)
+	default:
+		return nil, errors.New("split called with non-string, non-regex separator")
 	}
-	_, ok := hm.(HashMap).Val[key.(string)]
-	return ok, nil
+	if len(a) == 2 {
+		for len(parts) > 0 && parts[len(parts)-1] == "" {
+			parts = parts[:len(parts)-1]
+		}
+	}
+	slc := make([]MalType, 0, len(parts))
+	for _, p := range parts {
+		slc = append(slc, String(p))
+	}
+	return Vector{slc, nil}, nil
 }
 
-func keys(a []MalType) (MalType, error) {
-	if !HashMap_Q(a[0]) {
-		return nil, errors.New("keys called on non-hash map")
+// Number functions
+func time_ms(a []MalType) (MalType, error) {
+	return Int(time.Now().UnixNano() / int64(time.Millisecond)), nil
+}
+
+// Collection functions
+
+// to_slice returns the elements of any Seqable value, nil being empty
+func to_slice(name string, obj MalType) ([]MalType, error) {
+	if obj == nil {
+		return []MalType{}, nil
 	}
-	slc := []MalType{}
-	for k, _ := range a[0].(HashMap).Val {
-		slc = append(slc, k)
+	slc, e := GetSlice(obj)
+	if e != nil {
+		return nil, errors.New(name + " called on non-sequence")
 	}
-	return List{slc, nil}, nil
+	return slc, nil
 }
 
-func vals(a []MalType) (MalType, error) {
-	if !HashMap_Q(a[0]) {
-		return nil, errors.New("keys called on non-hash map")
+func count(a []MalType) (MalType, error) {
+	switch obj := a[0].(type) {
+	case nil:
+		return Int(0), nil
+	case Counted:
+		return Int(obj.Count()), nil
+	default:
+		return nil, errors.New("count not supported on " + TypeOf(obj))
 	}
-	slc := []MalType{}
-	for _, v := range a[0].(HashMap).Val {
-		slc = append(slc, v)
+}
+
+func empty_Q(a []MalType) (MalType, error) {
+	switch obj := a[0].(type) {
+	case nil:
+		return Bool(true), nil
+	case Counted:
+		return Bool(obj.Count() == 0), nil
+	case Seqable:
+		return Bool(obj.Seq() == nil), nil
+	default:
+		return nil, errors.New("empty? not supported on " + TypeOf(obj))
 	}
-	return List{slc, nil}, nil
 }
 
-// Sequence functions
+func nth(a []MalType) (MalType, error) {
+	coll, ok := a[0].(Indexed)
+	if !ok {
+		return nil, errors.New("nth not supported on " + TypeOf(a[0]))
+	}
+	idx, ok := a[1].(Int)
+	if !ok {
+		return nil, errors.New("nth called with non-integer index")
+	}
+	if v, ok := coll.Nth(int(idx)); ok {
+		return v, nil
+	} else {
+		return nil, errors.New("nth: index out of range")
+	}
+}
 
-func cons(a []MalType) (MalType, error) {
-	val := a[0]
-	lst, e := GetSlice(a[1])
+// lookup is get without the default: found is false for missing keys
+// and for nil
+func lookup(coll MalType, key MalType) (MalType, bool, error) {
+	if Nil_Q(coll) {
+		return nil, false, nil
+	}
+	l, ok := coll.(ILookup)
+	if !ok {
+		return nil, false, errors.New("get not supported on " + TypeOf(coll))
+	}
+	v, found := l.ValAt(key)
+	return v, found, nil
+}
+
+func get(a []MalType) (MalType, error) {
+	v, found, e := lookup(a[0], a[1])
 	if e != nil {
 		return nil, e
 	}
-	return List{append([]MalType{val}, lst...), nil}, nil
+	if !found && len(a) == 3 {
+		return a[2], nil
+	}
+	return v, nil
 }
 
-func concat(a []MalType) (MalType, error) {
-	if len(a) == 0 {
-		return List{}, nil
+func contains_Q(coll MalType, key MalType) (MalType, error) {
+	if Nil_Q(coll) {
+		return Bool(false), nil
+	}
+	assoc, ok := coll.(Associative)
+	if !ok {
+		return nil, errors.New("contains? not supported on " + TypeOf(coll))
+	}
+	return Bool(assoc.ContainsKey(key)), nil
+}
+
+func assoc(a []MalType) (MalType, error) {
+	if len(a)%2 != 1 {
+		return nil, errors.New("assoc requires odd number of arguments")
 	}
-	slc1, e := GetSlice(a[0])
+	switch coll := a[0].(type) {
+	case nil:
+		return HashMap{}.AssocAll(a[1:]...), nil
+	case HashMap:
+		return coll.AssocAll(a[1:]...), nil
+	case Associative:
+		res := a[0]
+		for i := 1; i < len(a); i += 2 {
+			var e error
+			if res, e = res.(Associative).Assoc(a[i], a[i+1]); e != nil {
+				return nil, e
+			}
+		}
+		return res, nil
+	default:
+		return nil, errors.New("assoc not supported on " + TypeOf(coll))
+	}
+}
+
+// Hash Map functions
+func dissoc(a []MalType) (MalType, error) {
+	if Nil_Q(a[0]) {
+		return nil, nil
+	}
+	return a[0].(HashMap).Dissoc(a[1:]...), nil
+}
+
+func find(a []MalType) (MalType, error) {
+	v, found, e := lookup(a[0], a[1])
+	if e != nil || !found {
+		return nil, e
+	}
+	return Vector{[]MalType{a[1], v}, nil}, nil
+}
+
+func get_in(a []MalType) (MalType, error) {
+	ks, e := to_slice("get-in", a[1])
 	if e != nil {
 		return nil, e
 	}
-	for i := 1; i < len(a); i += 1 {
-		slc2, e := GetSlice(a[i])
+	coll := a[0]
+	for _, k := range ks {
+		v, found, e := lookup(coll, k)
 		if e != nil {
 			return nil, e
 		}
-		slc1 = append(slc1, slc2...)
+		if !found {
+			if len(a) == 3 {
+				return a[2], nil
+			}
+			return nil, nil
+		}
+		coll = v
 	}
-	return List{slc1, nil}, nil
+	return coll, nil
 }
 
-func vec(a []MalType) (MalType, error) {
-	switch obj := a[0].(type) {
-	case Vector:
-		return obj, nil
-	case List:
-		return Vector{obj.Val, nil}, nil
-	default:
-		return nil, errors.New("vec: expects a sequence")
+func assoc_in(a []MalType) (MalType, error) {
+	ks, e := to_slice("assoc-in", a[1])
+	if e != nil {
+		return nil, e
+	}
+	if len(ks) == 0 {
+		return nil, errors.New("assoc-in requires at least one key")
+	}
+	if len(ks) == 1 {
+		return assoc([]MalType{a[0], ks[0], a[2]})
+	}
+	inner, _, e := lookup(a[0], ks[0])
+	if e != nil {
+		return nil, e
+	}
+	v, e := assoc_in([]MalType{inner, List{Val: ks[1:]}, a[2]})
+	if e != nil {
+		return nil, e
 	}
+	return assoc([]MalType{a[0], ks[0], v})
 }
 
-func nth(a []MalType) (MalType, error) {
-	slc, e := GetSlice(a[0])
+func update(a []MalType) (MalType, error) {
+	old, _, e := lookup(a[0], a[1])
 	if e != nil {
 		return nil, e
 	}
-	idx := a[1].(int)
-	if idx < len(slc) {
-		return slc[idx], nil
-	} else {
-		return nil, errors.New("nth: index out of range")
+	v, e := Apply(a[2], append([]MalType{old}, a[3:]...))
+	if e != nil {
+		return nil, e
 	}
+	return assoc([]MalType{a[0], a[1], v})
 }
 
-func first(a []MalType) (MalType, error) {
-	if len(a) == 0 {
-		return nil, nil
+func update_in(a []MalType) (MalType, error) {
+	ks, e := to_slice("update-in", a[1])
+	if e != nil {
+		return nil, e
 	}
-	if a[0] == nil {
-		return nil, nil
+	if len(ks) == 0 {
+		return nil, errors.New("update-in requires at least one key")
+	}
+	if len(ks) == 1 {
+		return update(append([]MalType{a[0], ks[0]}, a[2:]...))
 	}
-	slc, e := GetSlice(a[0])
+	inner, _, e := lookup(a[0], ks[0])
 	if e != nil {
 		return nil, e
 	}
-	if len(slc) == 0 {
-		return nil, nil
+	v, e := update_in(append([]MalType{inner, List{Val: ks[1:]}}, a[2:]...))
+	if e != nil {
+		return nil, e
 	}
-	return slc[0], nil
+	return assoc([]MalType{a[0], ks[0], v})
 }
 
-func rest(a []MalType) (MalType, error) {
-	if a[0] == nil {
-		return List{}, nil
+// merge_with combines maps left to right; f resolves keys present in
+// more than one map, and later values win when f is nil
+func merge_with(f MalType, maps []MalType) (MalType, error) {
+	var res MalType = nil
+	for _, m := range maps {
+		if m == nil {
+			continue
+		}
+		hm, ok := m.(HashMap)
+		if !ok {
+			return nil, errors.New("merge called with non-hash map")
+		}
+		if res == nil {
+			res = hm
+			continue
+		}
+		acc := res.(HashMap)
+		kvs := make([]MalType, 0, 2*hm.Count())
+		for _, entry := range hm.Entries() {
+			v := entry.Value
+			if old, found := acc.ValAt(entry.Key); found && f != nil {
+				var e error
+				if v, e = Apply(f, []MalType{old, v}); e != nil {
+					return nil, e
+				}
+			}
+			kvs = append(kvs, entry.Key, v)
+		}
+		res = acc.AssocAll(kvs...)
 	}
-	slc, e := GetSlice(a[0])
+	return res, nil
+}
+
+func merge(a []MalType) (MalType, error) {
+	return merge_with(nil, a)
+}
+
+func do_merge_with(a []MalType) (MalType, error) {
+	return merge_with(a[0], a[1:])
+}
+
+func select_keys(a []MalType) (MalType, error) {
+	ks, e := to_slice("select-keys", a[1])
 	if e != nil {
 		return nil, e
 	}
-	if len(slc) == 0 {
-		return List{}, nil
+	kvs := []MalType{}
+	for _, k := range ks {
+		v, found, e := lookup(a[0], k)
+		if e != nil {
+			return nil, e
+		}
+		if found {
+			kvs = append(kvs, k, v)
+		}
 	}
-	return List{slc[1:], nil}, nil
+	return HashMap{}.AssocAll(kvs...), nil
 }
 
-func empty_Q(a []MalType) (MalType, error) {
-	switch obj := a[0].(type) {
-	case List:
-		return len(obj.Val) == 0, nil
+func zipmap(a []MalType) (MalType, error) {
+	ks, e := to_slice("zipmap", a[0])
+	if e != nil {
+		return nil, e
+	}
+	vs, e := to_slice("zipmap", a[1])
+	if e != nil {
+		return nil, e
+	}
+	kvs := []MalType{}
+	for i := 0; i < len(ks) && i < len(vs); i += 1 {
+		kvs = append(kvs, ks[i], vs[i])
+	}
+	return HashMap{}.AssocAll(kvs...), nil
+}
+
+func reduce_kv(a []MalType) (MalType, error) {
+	f, acc := a[0], a[1]
+	switch coll := a[2].(type) {
+	case nil:
+		return acc, nil
+	case HashMap:
+		for _, entry := range coll.Entries() {
+			var e error
+			if acc, e = Apply(f, []MalType{acc, entry.Key, entry.Value}); e != nil {
+				return nil, e
+			}
+		}
 	case Vector:
-		return len(obj.Val) == 0, nil
+		for i, v := range coll.Val {
+			var e error
+			if acc, e = Apply(f, []MalType{acc, Int(i), v}); e != nil {
+				return nil, e
+			}
+		}
+	default:
+		return nil, errors.New("reduce-kv not supported on " + TypeOf(coll))
+	}
+	return acc, nil
+}
+
+// update_entries rebuilds a map applying f to either each key or each
+// value
+func update_entries(name string, a []MalType, keys bool) (MalType, error) {
+	if Nil_Q(a[0]) {
+		return HashMap{}, nil
+	}
+	hm, ok := a[0].(HashMap)
+	if !ok {
+		return nil, errors.New(name + " called on non-hash map")
+	}
+	kvs := make([]MalType, 0, 2*hm.Count())
+	for _, entry := range hm.Entries() {
+		k, v := entry.Key, entry.Value
+		var e error
+		if keys {
+			k, e = Apply(a[1], []MalType{k})
+		} else {
+			v, e = Apply(a[1], []MalType{v})
+		}
+		if e != nil {
+			return nil, e
+		}
+		kvs = append(kvs, k, v)
+	}
+	res := HashMap{}.AssocAll(kvs...)
+	res.Meta = hm.Meta
+	return res, nil
+}
+
+func keys(a []MalType) (MalType, error) {
+	if Nil_Q(a[0]) {
+		return nil, nil
+	}
+	return List{Val: a[0].(HashMap).Keys()}, nil
+}
+
+func vals(a []MalType) (MalType, error) {
+	if Nil_Q(a[0]) {
+		return nil, nil
+	}
+	return List{Val: a[0].(HashMap).Vals()}, nil
+}
+
+// Sequence functions
+
+func seq(a []MalType) (MalType, error) {
+	switch obj := a[0].(type) {
 	case nil:
-		return true, nil
+		return nil, nil
+	case Seqable:
+		return obj.Seq(), nil
 	default:
-		return nil, errors.New("empty? called on non-sequence")
+		return nil, errors.New("seq not supported on " + TypeOf(obj))
 	}
 }
 
-func count(a []MalType) (MalType, error) {
+func first(a []MalType) (MalType, error) {
+	s, e := seq(a)
+	if e != nil || s == nil {
+		return nil, e
+	}
+	return s.(List).Val[0], nil
+}
+
+func rest(a []MalType) (MalType, error) {
+	s, e := seq(a)
+	if e != nil {
+		return nil, e
+	}
+	if s == nil {
+		return List{}, nil
+	}
+	return s.(List).Rest(), nil
+}
+
+func cons(a []MalType) (MalType, error) {
+	if lst, ok := a[1].(List); ok {
+		return lst.Cons(a[0]), nil
+	}
+	lst, e := to_slice("cons", a[1])
+	if e != nil {
+		return nil, e
+	}
+	return List{Val: lst}.Cons(a[0]), nil
+}
+
+func concat(a []MalType) (MalType, error) {
+	slc := []MalType{}
+	for _, x := range a {
+		xs, e := to_slice("concat", x)
+		if e != nil {
+			return nil, e
+		}
+		slc = append(slc, xs...)
+	}
+	return List{Val: slc}, nil
+}
+
+func vec(a []MalType) (MalType, error) {
 	switch obj := a[0].(type) {
-	case List:
-		return len(obj.Val), nil
 	case Vector:
-		return len(obj.Val), nil
-	case map[string]MalType:
-		return len(obj), nil
-	case nil:
-		return 0, nil
+		return obj, nil
 	default:
-		return nil, errors.New("count called on non-sequence")
+		slc, e := to_slice("vec", obj)
+		if e != nil {
+			return nil, e
+		}
+		return Vector{slc, nil}, nil
 	}
 }
 
 func apply(a []MalType) (MalType, error) {
-	if len(a) < 2 {
-		return nil, errors.New("apply requires at least 2 args")
-	}
 	f := a[0]
 	args := []MalType{}
 	for _, b := range a[1 : len(a)-1] {
 		args = append(args, b)
 	}
-	last, e := GetSlice(a[len(a)-1])
+	last, e := to_slice("apply", a[len(a)-1])
 	if e != nil {
 		return nil, e
 	}
@@ -294,142 +727,248 @@ func apply(a []MalType) (MalType, error) {
 
 func do_map(a []MalType) (MalType, error) {
 	f := a[0]
-	results := []MalType{}
-	args, e := GetSlice(a[1])
+	args, e := to_slice("map", a[1])
 	if e != nil {
 		return nil, e
 	}
+	results := make([]MalType, 0, len(args))
 	for _, arg := range args {
 		res, e := Apply(f, []MalType{arg})
-		results = append(results, res)
 		if e != nil {
 			return nil, e
 		}
+		results = append(results, res)
 	}
-	return List{results, nil}, nil
+	return List{Val: results}, nil
 }
 
+// conj adds to the front of a list, the end of a vector, and takes
+// [key value] entries or other maps for a hash map
 func conj(a []MalType) (MalType, error) {
-	if len(a) < 2 {
-		return nil, errors.New("conj requires at least 2 arguments")
-	}
-	switch seq := a[0].(type) {
+	switch coll := a[0].(type) {
+	case nil:
+		return conj(append([]MalType{List{}}, a[1:]...))
 	case List:
-		new_slc := []MalType{}
-		for i := len(a) - 1; i > 0; i -= 1 {
-			new_slc = append(new_slc, a[i])
+		for _, x := range a[1:] {
+			coll = coll.Cons(x)
 		}
-		return List{append(new_slc, seq.Val...), nil}, nil
+		return coll, nil
 	case Vector:
-		new_slc := seq.Val
+		new_slc := make([]MalType, 0, len(coll.Val)+len(a)-1)
+		new_slc = append(new_slc, coll.Val...)
+		return Vector{append(new_slc, a[1:]...), nil}, nil
+	case HashMap:
+		kvs := []MalType{}
 		for _, x := range a[1:] {
-			new_slc = append(new_slc, x)
+			switch entry := x.(type) {
+			case nil:
+			case Vector:
+				if len(entry.Val) != 2 {
+					return nil, errors.New("conj on a map requires [key value] entries")
+				}
+				kvs = append(kvs, entry.Val...)
+			case HashMap:
+				for _, kv := range entry.Entries() {
+					kvs = append(kvs, kv.Key, kv.Value)
+				}
+			default:
+				return nil, errors.New("conj on a map requires [key value] entries")
+			}
 		}
-		return Vector{new_slc, nil}, nil
+		return coll.AssocAll(kvs...), nil
+	default:
+		return nil, errors.New("conj not supported on " + TypeOf(coll))
+	}
+}
+
+func into(a []MalType) (MalType, error) {
+	from, e := to_slice("into", a[1])
+	if e != nil {
+		return nil, e
+	}
+	if len(from) == 0 {
+		return a[0], nil
 	}
+	return conj(append([]MalType{a[0]}, from...))
+}
 
-	if !HashMap_Q(a[0]) {
-		return nil, errors.New("dissoc called on non-hash map")
+// Transient functions
+func transient(a []MalType) (MalType, error) {
+	switch obj := a[0].(type) {
+	case Vector:
+		slc := make([]MalType, len(obj.Val))
+		copy(slc, obj.Val)
+		return &TransientVector{slc, true}, nil
+	case HashMap:
+		return NewTransientHashMap(obj), nil
+	default:
+		return nil, errors.New("transient called on non-vector, non-hash map")
 	}
-	new_hm := copy_hash_map(a[0].(HashMap))
-	for i := 1; i < len(a); i += 1 {
-		key := a[i]
-		if !String_Q(key) {
-			return nil, errors.New("dissoc called with non-string key")
+}
+
+func check_transient(name string, obj MalType) error {
+	switch t := obj.(type) {
+	case *TransientVector:
+		if t.Editable {
+			return nil
+		}
+	case *TransientHashMap:
+		if t.Editable {
+			return nil
 		}
-		delete(new_hm.Val, key.(string))
+	default:
+		return errors.New(name + " called on non-transient")
 	}
-	return new_hm, nil
+	return errors.New(name + " called on transient after persistent!")
 }
 
-func seq(a []MalType) (MalType, error) {
-	if a[0] == nil {
-		return nil, nil
+func conj_BANG(a []MalType) (MalType, error) {
+	if e := check_transient("conj!", a[0]); e != nil {
+		return nil, e
 	}
-	switch arg := a[0].(type) {
-	case List:
-		if len(arg.Val) == 0 {
-			return nil, nil
-		}
-		return arg, nil
-	case Vector:
-		if len(arg.Val) == 0 {
-			return nil, nil
+	switch t := a[0].(type) {
+	case *TransientVector:
+		t.Val = append(t.Val, a[1:]...)
+	case *TransientHashMap:
+		for _, x := range a[1:] {
+			switch entry := x.(type) {
+			case Vector:
+				if len(entry.Val) != 2 {
+					return nil, errors.New("conj! on a map requires [key value] entries")
+				}
+				t.Assoc(entry.Val[0], entry.Val[1])
+			case HashMap:
+				for _, kv := range entry.Entries() {
+					t.Assoc(kv.Key, kv.Value)
+				}
+			default:
+				return nil, errors.New("conj! on a map requires [key value] entries")
+			}
 		}
-		return List{arg.Val, nil}, nil
-	case string:
-		if len(arg) == 0 {
-			return nil, nil
+	}
+	return a[0], nil
+}
+
+func assoc_BANG(a []MalType) (MalType, error) {
+	if len(a)%2 != 1 {
+		return nil, errors.New("assoc! requires key/value pairs")
+	}
+	if e := check_transient("assoc!", a[0]); e != nil {
+		return nil, e
+	}
+	switch t := a[0].(type) {
+	case *TransientVector:
+		for i := 1; i < len(a); i += 2 {
+			n, ok := a[i].(Int)
+			if !ok {
+				return nil, errors.New("assoc! on a vector requires integer indexes")
+			}
+			idx := int(n)
+			if idx == len(t.Val) {
+				t.Val = append(t.Val, a[i+1])
+			} else if 0 <= idx && idx < len(t.Val) {
+				t.Val[idx] = a[i+1]
+			} else {
+				return nil, errors.New("assoc!: index out of range")
+			}
 		}
-		new_slc := []MalType{}
-		for _, ch := range strings.Split(arg, "") {
-			new_slc = append(new_slc, ch)
+	case *TransientHashMap:
+		for i := 1; i < len(a); i += 2 {
+			t.Assoc(a[i], a[i+1])
 		}
-		return List{new_slc, nil}, nil
 	}
-	return nil, errors.New("seq requires string or list or vector or nil")
+	return a[0], nil
 }
 
-// Metadata functions
-func with_meta(a []MalType) (MalType, error) {
-	obj := a[0]
-	m := a[1]
-	switch tobj := obj.(type) {
-	case List:
-		return List{tobj.Val, m}, nil
-	case Vector:
-		return Vector{tobj.Val, m}, nil
-	case HashMap:
-		return HashMap{tobj.Val, m}, nil
-	case Func:
-		return Func{tobj.Fn, m}, nil
-	case MalFunc:
-		fn := tobj
-		fn.Meta = m
-		return fn, nil
+func dissoc_BANG(a []MalType) (MalType, error) {
+	if e := check_transient("dissoc!", a[0]); e != nil {
+		return nil, e
+	}
+	t, ok := a[0].(*TransientHashMap)
+	if !ok {
+		return nil, errors.New("dissoc! called on non-map transient")
+	}
+	for _, key := range a[1:] {
+		t.Dissoc(key)
+	}
+	return t, nil
+}
+
+func pop_BANG(a []MalType) (MalType, error) {
+	if e := check_transient("pop!", a[0]); e != nil {
+		return nil, e
+	}
+	t, ok := a[0].(*TransientVector)
+	if !ok {
+		return nil, errors.New("pop! called on non-vector transient")
+	}
+	if len(t.Val) == 0 {
+		return nil, errors.New("pop! called on empty transient")
+	}
+	t.Val[len(t.Val)-1] = nil
+	t.Val = t.Val[:len(t.Val)-1]
+	return t, nil
+}
+
+func persistent_BANG(a []MalType) (MalType, error) {
+	if e := check_transient("persistent!", a[0]); e != nil {
+		return nil, e
+	}
+	switch t := a[0].(type) {
+	case *TransientVector:
+		return t.Persistent(), nil
 	default:
-		return nil, errors.New("with-meta not supported on type")
+		return t.(*TransientHashMap).Persistent(), nil
 	}
 }
 
+// Metadata functions
+func with_meta(a []MalType) (MalType, error) {
+	return WithMeta(a[0], a[1])
+}
+
 func meta(a []MalType) (MalType, error) {
-	obj := a[0]
-	switch tobj := obj.(type) {
-	case List:
-		return tobj.Meta, nil
-	case Vector:
-		return tobj.Meta, nil
-	case HashMap:
-		return tobj.Meta, nil
-	case Func:
-		return tobj.Meta, nil
-	case MalFunc:
-		return tobj.Meta, nil
-	default:
-		return nil, errors.New("meta not supported on type")
+	return Meta(a[0])
+}
+
+func vary_meta(a []MalType) (MalType, error) {
+	m, e := meta(a[:1])
+	if e != nil {
+		return nil, e
+	}
+	m, e = Apply(a[1], append([]MalType{m}, a[2:]...))
+	if e != nil {
+		return nil, e
+	}
+	return with_meta([]MalType{a[0], m})
+}
+
+func alter_meta_BANG(a []MalType) (MalType, error) {
+	atm := a[0].(*Atom)
+	m, e := Apply(a[1], append([]MalType{atm.Meta}, a[2:]...))
+	if e != nil {
+		return nil, e
 	}
+	atm.Meta = m
+	return m, nil
+}
+
+func reset_meta_BANG(a []MalType) (MalType, error) {
+	a[0].(*Atom).Meta = a[1]
+	return a[1], nil
 }
 
 // Atom functions
 func deref(a []MalType) (MalType, error) {
-	if !Atom_Q(a[0]) {
-		return nil, errors.New("deref called with non-atom")
-	}
 	return a[0].(*Atom).Val, nil
 }
 
 func reset_BANG(a []MalType) (MalType, error) {
-	if !Atom_Q(a[0]) {
-		return nil, errors.New("reset! called with non-atom")
-	}
 	a[0].(*Atom).Set(a[1])
 	return a[1], nil
 }
 
 func swap_BANG(a []MalType) (MalType, error) {
-	if !Atom_Q(a[0]) {
-		return nil, errors.New("swap! called with non-atom")
-	}
 	atm := a[0].(*Atom)
 	args := []MalType{atm.Val}
 	f := a[1]
@@ -442,126 +981,169 @@ func swap_BANG(a []MalType) (MalType, error) {
 	return res, nil
 }
 
-// core namespace
-var NS = map[string]MalType{
-	"=":       call2b(Equal_Q),
-	"throw":   call1e(throw),
-	"nil?":    call1b(Nil_Q),
-	"true?":   call1b(True_Q),
-	"false?":  call1b(False_Q),
-	"symbol":  call1e(func(a []MalType) (MalType, error) { return Symbol{a[0].(string)}, nil }),
-	"symbol?": call1b(Symbol_Q),
-	"string?": call1e(func(a []MalType) (MalType, error) { return (String_Q(a[0]) && !Keyword_Q(a[0])), nil }),
-	"keyword": call1e(func(a []MalType) (MalType, error) {
+var gensyms = 0
+
+// Gensym makes a new symbol: prefix followed by a number no earlier
+// call used
+func Gensym(prefix string) Symbol {
+	gensyms += 1
+	return NewSymbol(fmt.Sprintf("%s%d", prefix, gensyms))
+}
+
+func gensym(a []MalType) (MalType, error) {
+	prefix := "G__"
+	if len(a) > 0 {
+		prefix = string(a[0].(String))
+	}
+	return Gensym(prefix), nil
+}
+
+// the documentation of the builtins, for doc
+func doc(a []MalType) (MalType, error) {
+	var name string
+	switch n := a[0].(type) {
+	case Symbol:
+		name = n.Val
+	case String:
+		name = string(n)
+	}
+	s, ok := sigs[name]
+	if !ok {
+		return nil, errors.New("doc: no builtin named " + name)
+	}
+	fmt.Println("(" + strings.TrimSpace(name+" "+s.text) + ")")
+	fmt.Println("  " + s.doc)
+	return nil, nil
+}
+
+func is(f func(MalType) bool) func([]MalType) (MalType, error) {
+	return func(a []MalType) (MalType, error) { return Bool(f(a[0])), nil }
+}
+
+// core namespace. Each builtin is declared with its parameters, from
+// which its arguments are checked (see sig.go), and a docstring.
+var builtins = map[string]builtin{
+	"=":          {"x y", "Returns true if x and y are equal.", func(a []MalType) (MalType, error) { return Bool(Equal_Q(a[0], a[1])), nil }},
+	"throw":      {"x", "Throws x, to be caught by try*/catch*.", throw},
+	"ex-info":    {"msg:string data:map [cause]", "Returns an exception to throw, with the message msg, the map data and the exception cause that led to it.", ex_info},
+	"ex-message": {"ex", "Returns the message of the ex-info ex, or nil for any other value.", ex_message},
+	"ex-data":    {"ex", "Returns the data map of the ex-info ex, or nil for any other value. Errors raised by the interpreter have a :type.", ex_data},
+	"ex-cause":   {"ex", "Returns the cause of the ex-info ex, or nil.", ex_cause},
+	"nil?":       {"x", "Returns true if x is nil.", is(Nil_Q)},
+	"true?":      {"x", "Returns true if x is true.", is(True_Q)},
+	"false?":     {"x", "Returns true if x is false.", is(False_Q)},
+	"symbol":     {"name:string", "Returns the symbol with the given name.", func(a []MalType) (MalType, error) { return NewSymbol(string(a[0].(String))), nil }},
+	"symbol?":    {"x", "Returns true if x is a symbol.", is(Symbol_Q)},
+	"gensym":     {"[prefix:string]", "Returns a new symbol with a unique name, prefix (default \"G__\") followed by a number.", gensym},
+	"string?":    {"x", "Returns true if x is a string.", is(String_Q)},
+	"keyword": {"name:named", "Returns the keyword with the given name; a keyword is returned as it is.", func(a []MalType) (MalType, error) {
 		if Keyword_Q(a[0]) {
 			return a[0], nil
 		} else {
-			return NewKeyword(a[0].(string))
-		}
-	}),
-	"keyword?":    call1b(Keyword_Q),
-	"number?":     call1b(Number_Q),
-	"fn?":         call1e(fn_q),
-	"macro?":      call1e(func(a []MalType) (MalType, error) { return MalFunc_Q(a[0]) && a[0].(MalFunc).GetMacro(), nil }),
-	"pr-str":      callNe(pr_str),
-	"str":         callNe(str),
-	"prn":         callNe(prn),
-	"println":     callNe(println),
-	"read-string": call1e(func(a []MalType) (MalType, error) { return reader.Read_str(a[0].(string)) }),
-	"slurp":       call1e(slurp),
-	"readline":    call1e(func(a []MalType) (MalType, error) { return readline.Readline(a[0].(string)) }),
-	"<":           call2e(func(a []MalType) (MalType, error) { return a[0].(int) < a[1].(int), nil }),
-	"<=":          call2e(func(a []MalType) (MalType, error) { return a[0].(int) <= a[1].(int), nil }),
-	">":           call2e(func(a []MalType) (MalType, error) { return a[0].(int) > a[1].(int), nil }),
-	">=":          call2e(func(a []MalType) (MalType, error) { return a[0].(int) >= a[1].(int), nil }),
-	"+":           call2e(func(a []MalType) (MalType, error) { return a[0].(int) + a[1].(int), nil }),
-	"-":           call2e(func(a []MalType) (MalType, error) { return a[0].(int) - a[1].(int), nil }),
-	"*":           call2e(func(a []MalType) (MalType, error) { return a[0].(int) * a[1].(int), nil }),
-	"/":           call2e(func(a []MalType) (MalType, error) { return a[0].(int) / a[1].(int), nil }),
-	"time-ms":     call0e(time_ms),
-	"list":        callNe(func(a []MalType) (MalType, error) { return List{a, nil}, nil }),
-	"list?":       call1b(List_Q),
-	"vector":      callNe(func(a []MalType) (MalType, error) { return Vector{a, nil}, nil }),
-	"vector?":     call1b(Vector_Q),
-	"hash-map":    callNe(func(a []MalType) (MalType, error) { return NewHashMap(List{a, nil}) }),
-	"map?":        call1b(HashMap_Q),
-	"assoc":       callNe(assoc),  // at least 3
-	"dissoc":      callNe(dissoc), // at least 2
-	"get":         call2e(get),
-	"contains?":   call2e(func(a []MalType) (MalType, error) { return contains_Q(a[0], a[1]) }),
-	"keys":        call1e(keys),
-	"vals":        call1e(vals),
-	"sequential?": call1b(Sequential_Q),
-	"cons":        call2e(cons),
-	"concat":      callNe(concat),
-	"vec":         call1e(vec),
-	"nth":         call2e(nth),
-	"first":       call1e(first),
-	"rest":        call1e(rest),
-	"empty?":      call1e(empty_Q),
-	"count":       call1e(count),
-	"apply":       callNe(apply), // at least 2
-	"map":         call2e(do_map),
-	"conj":        callNe(conj), // at least 2
-	"seq":         call1e(seq),
-	"with-meta":   call2e(with_meta),
-	"meta":        call1e(meta),
-	"atom":        call1e(func(a []MalType) (MalType, error) { return &Atom{a[0], nil}, nil }),
-	"atom?":       call1b(Atom_Q),
-	"deref":       call1e(deref),
-	"reset!":      call2e(reset_BANG),
-	"swap!":       callNe(swap_BANG),
-}
-
-// callXX functions check the number of arguments
-func call0e(f func([]MalType) (MalType, error)) func([]MalType) (MalType, error) {
-	return func(args []MalType) (MalType, error) {
-		if len(args) != 0 {
-			return nil, fmt.Errorf("wrong number of arguments (%d instead of 0)", len(args))
-		}
-		return f(args)
-	}
-}
-
-func call1e(f func([]MalType) (MalType, error)) func([]MalType) (MalType, error) {
-	return func(args []MalType) (MalType, error) {
-		if len(args) != 1 {
-			return nil, fmt.Errorf("wrong number of arguments (%d instead of 1)", len(args))
-		}
-		return f(args)
-	}
-}
-
-func call2e(f func([]MalType) (MalType, error)) func([]MalType) (MalType, error) {
-	return func(args []MalType) (MalType, error) {
-		if len(args) != 2 {
-			return nil, fmt.Errorf("wrong number of arguments (%d instead of 2)", len(args))
-		}
-		return f(args)
-	}
-}
-
-func callNe(f func([]MalType) (MalType, error)) func([]MalType) (MalType, error) {
-	// just for documenting purposes, does not check anything
-	return func(args []MalType) (MalType, error) {
-		return f(args)
-	}
-}
-
-func call1b(f func(MalType) bool) func([]MalType) (MalType, error) {
-	return func(args []MalType) (MalType, error) {
-		if len(args) != 1 {
-			return nil, fmt.Errorf("wrong number of arguments (%d instead of 1)", len(args))
-		}
-		return f(args[0]), nil
-	}
-}
-
-func call2b(f func(MalType, MalType) bool) func([]MalType) (MalType, error) {
-	return func(args []MalType) (MalType, error) {
-		if len(args) != 2 {
-			return nil, fmt.Errorf("wrong number of arguments (%d instead of 2)", len(args))
-		}
-		return f(args[0], args[1]), nil
+			return NewKeyword(string(a[0].(String)))
+		}
+	}},
+	"keyword?":    {"x", "Returns true if x is a keyword.", is(Keyword_Q)},
+	"number?":     {"x", "Returns true if x is a number.", is(Number_Q)},
+	"fn?":         {"x", "Returns true if x is a function and not a macro.", fn_q},
+	"macro?":      {"x", "Returns true if x is a macro.", func(a []MalType) (MalType, error) { return Bool(MalFunc_Q(a[0]) && a[0].(*MalFunc).GetMacro()), nil }},
+	"pr-str":      {"& xs", "Returns the readable printed forms of xs, separated by spaces.", pr_str},
+	"str":         {"& xs", "Returns the printed forms of xs concatenated, strings as they are.", str},
+	"prn":         {"& xs", "Prints xs as pr-str does, followed by a newline.", prn},
+	"println":     {"& xs", "Prints xs separated by spaces, strings as they are, followed by a newline.", println},
+	"read-string": {"s:string", "Reads a form from s.", func(a []MalType) (MalType, error) { return reader.Read_str(string(a[0].(String))) }},
+	"slurp":       {"file:string", "Returns the contents of a file.", slurp},
+	"readline":    {"prompt:string", "Reads a line from the terminal after showing prompt.", do_readline},
+	"<":           {"x:num y:num", "Returns true if x is less than y.", func(a []MalType) (MalType, error) { return Bool(a[0].(Int) < a[1].(Int)), nil }},
+	"<=":          {"x:num y:num", "Returns true if x is less than or equal to y.", func(a []MalType) (MalType, error) { return Bool(a[0].(Int) <= a[1].(Int)), nil }},
+	">":           {"x:num y:num", "Returns true if x is greater than y.", func(a []MalType) (MalType, error) { return Bool(a[0].(Int) > a[1].(Int)), nil }},
+	">=":          {"x:num y:num", "Returns true if x is greater than or equal to y.", func(a []MalType) (MalType, error) { return Bool(a[0].(Int) >= a[1].(Int)), nil }},
+	"+":           {"x:num y:num", "Returns the sum of x and y.", func(a []MalType) (MalType, error) { return a[0].(Int) + a[1].(Int), nil }},
+	"-":           {"x:num y:num", "Returns x minus y.", func(a []MalType) (MalType, error) { return a[0].(Int) - a[1].(Int), nil }},
+	"*":           {"x:num y:num", "Returns the product of x and y.", func(a []MalType) (MalType, error) { return a[0].(Int) * a[1].(Int), nil }},
+	"/":           {"x:num y:num", "Returns x divided by y, rounded toward zero.", func(a []MalType) (MalType, error) { return a[0].(Int) / a[1].(Int), nil }},
+	"time-ms":     {"", "Returns the current time in milliseconds since the epoch.", time_ms},
+	"regex?":      {"x", "Returns true if x is a regex.", is(Regex_Q)},
+	"re-pattern":  {"s:re", "Returns the regex s, compiled when it is a string.", re_pattern},
+	"re-find":     {"re:re s:string", "Returns the first match of re in s: the matched string, or a vector of it and the groups when re has groups.", re_find},
+	"re-matches":  {"re:re s:string", "Like re-find, but re must match the whole of s.", re_matches},
+	"re-seq":      {"re:re s:string", "Returns a list of the matches of re in s, each as re-find returns it, or nil.", re_seq},
+	"re-groups":   {"re:re s:string", "Returns a map from keyword to matched string for the named groups of the first match of re in s.", re_groups},
+	"replace":     {"s:string match replacement", "Replaces every occurrence of match, a string or regex, in s. With a regex, replacement may refer to groups as $1 or ${name}, or be a function of the match.", replace},
+	"split":       {"s:string sep:re [limit:int]", "Splits s on sep, a string or regex, into a vector. Without a limit, trailing empty strings are dropped.", split},
+	"list":        {"& items", "Returns a list of items.", func(a []MalType) (MalType, error) { return List{Val: a}, nil }},
+	"list?":       {"x", "Returns true if x is a list.", is(List_Q)},
+	"vector":      {"& items", "Returns a vector of items.", func(a []MalType) (MalType, error) { return Vector{a, nil}, nil }},
+	"vector?":     {"x", "Returns true if x is a vector.", is(Vector_Q)},
+	"hash-map":    {"& kvs", "Returns a map of the keys and values in kvs.", func(a []MalType) (MalType, error) { return NewHashMap(List{Val: a}) }},
+	"map?":        {"x", "Returns true if x is a map.", is(HashMap_Q)},
+	"assoc":       {"map:associative key val & kvs", "Returns map with key mapped to val, and so on for the pairs in kvs. A vector takes indexes as keys.", assoc},
+	"dissoc":      {"map:map & ks", "Returns map without the keys ks.", dissoc},
+	"get":         {"map:lookup key [not-found]", "Returns the value of key in map, or not-found (default nil) when it is missing.", get},
+	"get-in":      {"map:lookup ks:seqable [not-found]", "Returns the value found by following the keys ks into nested maps, or not-found (default nil).", get_in},
+	"find":        {"map:lookup key", "Returns the [key value] entry of key in map, or nil.", find},
+	"assoc-in":    {"map:associative ks:seqable val", "Returns map with val at the path ks into nested maps, which are created as needed.", assoc_in},
+	"update":      {"map:associative key f:fn & args", "Returns map with the value of key replaced by (f old args...).", update},
+	"update-in":   {"map:associative ks:seqable f:fn & args", "Returns map with the value at the path ks into nested maps replaced by (f old args...).", update_in},
+	"merge":       {"& maps:map", "Returns the maps merged left to right, later values winning, or nil when they all are nil.", merge},
+	"merge-with":  {"f:fn & maps:map", "Like merge, but the values of a key found in more than one map are combined with (f old new).", do_merge_with},
+	"select-keys": {"map:lookup ks:seqable", "Returns a map of the entries of map whose key is in ks.", select_keys},
+	"zipmap":      {"ks:seqable vs:seqable", "Returns a map with each of ks mapped to the value at the same position in vs.", zipmap},
+	"reduce-kv":   {"f:fn init coll:associative", "Reduces the keys and values of a map, or the indexes and elements of a vector, with (f acc k v), starting from init.", reduce_kv},
+	"update-keys": {"map:map f:fn", "Returns map with f applied to every key.", func(a []MalType) (MalType, error) { return update_entries("update-keys", a, true) }},
+	"update-vals": {"map:map f:fn", "Returns map with f applied to every value.", func(a []MalType) (MalType, error) { return update_entries("update-vals", a, false) }},
+	"contains?":   {"coll:associative key", "Returns true if key is a key of the map coll, or an index of the vector coll.", func(a []MalType) (MalType, error) { return contains_Q(a[0], a[1]) }},
+	"keys":        {"map:map", "Returns a list of the keys of map, or nil when map is nil.", keys},
+	"vals":        {"map:map", "Returns a list of the values of map, or nil when map is nil.", vals},
+	"sequential?": {"x", "Returns true if x is a list or vector.", is(Sequential_Q)},
+	"cons":        {"x coll:seqable", "Returns a list of x followed by the elements of coll.", cons},
+	"concat":      {"& colls:seqable", "Returns a list of the elements of each of colls in turn.", concat},
+	"vec":         {"coll:seqable", "Returns a vector of the elements of coll.", vec},
+	"nth":         {"coll:indexed index:int", "Returns the element of coll at index, failing when there is none.", nth},
+	"first":       {"coll:seqable", "Returns the first element of coll, or nil when it is empty.", first},
+	"rest":        {"coll:seqable", "Returns a list of the elements of coll after the first.", rest},
+	"empty?":      {"coll:counted", "Returns true if coll has no elements.", empty_Q},
+	"count":       {"coll:counted", "Returns the number of elements of coll.", count},
+	"apply":       {"f:fn x & args", "Calls f with the arguments x and args, the last of which is a collection of further arguments.", apply},
+	"map":         {"f:fn coll:seqable", "Returns a list of (f x) for each element x of coll.", do_map},
+	"conj":        {"coll:collection x & xs", "Returns coll with x and xs added: to the front of a list, the end of a vector, and as [key value] entries or maps to a map.", conj},
+	"into":        {"to:collection from:seqable", "Returns to with the elements of from added, as by conj.", into},
+	"seq":         {"coll:seqable", "Returns a list of the elements of coll, or nil when it is empty. A string gives its characters, a map its [key value] entries.", seq},
+	"transient":   {"coll:editable", "Returns a transient copy of a vector or map, to be changed in place.", transient},
+	"conj!":       {"t:transient & xs", "Adds xs to the transient t, as conj does, and returns it.", conj_BANG},
+	"assoc!":      {"t:transient key val & kvs", "Maps key to val, and so on for the pairs in kvs, in the transient t and returns it.", assoc_BANG},
+	"dissoc!":     {"t:transient & ks", "Removes the keys ks from the transient map t and returns it.", dissoc_BANG},
+	"pop!":        {"t:transient", "Removes the last element of the transient vector t and returns it.", pop_BANG},
+	"persistent!": {"t:transient", "Returns the contents of the transient t as a vector or map. t cannot be changed any more.", persistent_BANG},
+	"with-meta":   {"obj m", "Returns obj with the metadata m.", with_meta},
+	"meta":        {"obj", "Returns the metadata of obj.", meta},
+	"vary-meta":   {"obj f:fn & args", "Returns obj with the metadata (f old args...).", vary_meta},
+	"alter-meta!": {"a:atom f:fn & args", "Sets the metadata of the atom a to (f old args...) and returns it.", alter_meta_BANG},
+	"reset-meta!": {"a:atom m", "Sets the metadata of the atom a to m and returns it.", reset_meta_BANG},
+	"atom":        {"x", "Returns an atom holding x.", func(a []MalType) (MalType, error) { return &Atom{a[0], nil}, nil }},
+	"atom?":       {"x", "Returns true if x is an atom.", is(Atom_Q)},
+	"deref":       {"a:atom", "Returns the value held by the atom a.", deref},
+	"reset!":      {"a:atom x", "Sets the value of the atom a to x and returns it.", reset_BANG},
+	"swap!":       {"a:atom f:fn & args", "Sets the value of the atom a to (f old args...) and returns it.", swap_BANG},
+	"doc*":        {"name:symbol", "Prints the parameters and the docstring of the builtin name. The doc macro calls it with the symbol it is given.", doc},
+}
+
+// NS has the builtins checking their arguments, for the steps
+var NS = map[string]func([]MalType) (MalType, error){}
+
+// Define declares a builtin made outside the core, such as eval, which
+// needs the interpreter. It gives the function checking its arguments
+// like those of NS, and doc knows it.
+func Define(name string, params string, doc string, fn func([]MalType) (MalType, error)) func([]MalType) (MalType, error) {
+	s := parse_sig(params, doc)
+	sigs[name] = s
+	return s.wrap(name, fn)
+}
+
+func init() {
+	for name, b := range builtins {
+		s := parse_sig(b.params, b.doc)
+		sigs[name] = s
+		NS[name] = s.wrap(name, b.fn)
 	}
 }
@@ -0,0 +1,162 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+import (
+	. "mal/src/types"
+)
+
+// builtin is an entry of the core namespace. params is written like an
+// argument list, "map:associative key val & kvs": name:kind only
+// accepts values of a kind from kinds, [name] may be left out, and the
+// parameter after & takes the remaining arguments.
+type builtin struct {
+	params string
+	doc    string
+	fn     func([]MalType) (MalType, error)
+}
+
+type kind struct {
+	desc  string
+	check func(MalType) bool
+}
+
+var kinds = map[string]kind{
+	"num":    {"a number", Number_Q},
+	"int":    {"an integer", Number_Q},
+	"string": {"a string", String_Q},
+	"named":  {"a string or keyword", func(x MalType) bool { return String_Q(x) || Keyword_Q(x) }},
+	"symbol": {"a symbol or string", func(x MalType) bool { return Symbol_Q(x) || String_Q(x) }},
+	"re":     {"a regex or string", func(x MalType) bool { return Regex_Q(x) || String_Q(x) }},
+	"fn":     {"a function", func(x MalType) bool { return Func_Q(x) || MalFunc_Q(x) || IFn_Q(x) }},
+	"atom":   {"an atom", Atom_Q},
+	"map":    {"a map", func(x MalType) bool { return x == nil || HashMap_Q(x) }},
+	"seqable": {"a collection", func(x MalType) bool {
+		_, ok := x.(Seqable)
+		return x == nil || ok
+	}},
+	"counted": {"a collection", func(x MalType) bool {
+		_, ok := x.(Counted)
+		return x == nil || ok
+	}},
+	"indexed": {"an indexed collection", func(x MalType) bool {
+		_, ok := x.(Indexed)
+		return ok
+	}},
+	"lookup": {"a map or vector", func(x MalType) bool {
+		_, ok := x.(ILookup)
+		return x == nil || ok
+	}},
+	"associative": {"a map or vector", func(x MalType) bool {
+		_, ok := x.(Associative)
+		return x == nil || ok
+	}},
+	"collection": {"a list, vector or map", func(x MalType) bool {
+		return x == nil || List_Q(x) || Vector_Q(x) || HashMap_Q(x)
+	}},
+	"editable":  {"a vector or map", func(x MalType) bool { return Vector_Q(x) || HashMap_Q(x) }},
+	"transient": {"a transient", func(x MalType) bool { return TransientVector_Q(x) || TransientHashMap_Q(x) }},
+}
+
+type param struct {
+	name string
+	kind *kind // nil for any value
+}
+
+// sig is the parsed form of the params of a builtin
+type sig struct {
+	params []param
+	min    int    // how many params are required
+	rest   *param // nil unless variadic
+	text   string // the argument list without kinds
+	doc    string
+}
+
+// the signatures of the builtins, by name
+var sigs = map[string]*sig{}
+
+func parse_sig(params string, doc string) *sig {
+	s := &sig{doc: doc}
+	names := []string{}
+	variadic := false
+	for _, field := range strings.Fields(params) {
+		if field == "&" {
+			variadic = true
+			names = append(names, field)
+			continue
+		}
+		optional := strings.HasPrefix(field, "[")
+		field = strings.Trim(field, "[]")
+		p := param{name: field}
+		if i := strings.Index(field, ":"); i >= 0 {
+			k, ok := kinds[field[i+1:]]
+			if !ok {
+				panic("unknown kind in builtin parameters: " + params)
+			}
+			p = param{field[:i], &k}
+		}
+		if optional {
+			names = append(names, "["+p.name+"]")
+		} else {
+			names = append(names, p.name)
+		}
+		if variadic {
+			s.rest = &p
+		} else {
+			s.params = append(s.params, p)
+			if !optional {
+				s.min += 1
+			}
+		}
+	}
+	s.text = strings.Join(names, " ")
+	return s
+}
+
+// arity describes the numbers of arguments s takes
+func (s *sig) arity() string {
+	min, max := strconv.Itoa(s.min), strconv.Itoa(len(s.params))
+	switch {
+	case s.rest != nil:
+		return "at least " + min
+	case s.min == len(s.params):
+		return min
+	case s.min+1 == len(s.params):
+		return min + " or " + max
+	default:
+		return min + " to " + max
+	}
+}
+
+func (s *sig) check(name string, a []MalType) error {
+	if len(a) < s.min || (s.rest == nil && len(a) > len(s.params)) {
+		return NewError("arity", fmt.Sprintf("wrong number of arguments (%d instead of %s)", len(a), s.arity()))
+	}
+	for i, x := range a {
+		p := s.rest
+		if i < len(s.params) {
+			p = &s.params[i]
+		}
+		if p.kind != nil && !p.kind.check(x) {
+			return NewError("type", fmt.Sprintf("%s: argument %d must be %s, got %s", name, i+1, p.kind.desc, TypeOf(x)))
+		}
+	}
+	return nil
+}
+
+// wrap makes the function the NS has for the builtin name: f, after
+// checking the arguments, with the panics it may still raise turned
+// into errors
+func (s *sig) wrap(name string, f func([]MalType) (MalType, error)) func([]MalType) (MalType, error) {
+	return func(a []MalType) (res MalType, e error) {
+		if err := s.check(name, a); err != nil {
+			return nil, err
+		}
+		defer Recover(name, a, &e)
+		return f(a)
+	}
+}
@@ -2,20 +2,42 @@ package env
 
 import (
 	"errors"
-	//"fmt"
+	"fmt"
 )
 
 import (
 	. "mal/src/types"
 )
 
+// Env is a frame of the environment chain. A frame keeps the Ids of
+// its symbols and their values in parallel slices, so that code
+// compiled against its layout can address a value by (depth, index)
+// instead of by name. The outermost Env holds the globals, in a table
+// of Vars.
 type Env struct {
-	data  map[string]MalType
-	outer EnvType
+	ids   []uint32
+	vals  []MalType
+	outer *Env
+	vars  map[uint32]*Var
 }
 
-func NewEnv(outer EnvType, binds_mt MalType, exprs_mt MalType) (EnvType, error) {
-	env := Env{map[string]MalType{}, outer}
+// Var is a global binding. Compiled code looks a Var up once and
+// keeps it; it stays the same Var when the global is redefined.
+type Var struct {
+	Name  string
+	Val   MalType
+	Bound bool
+}
+
+func NewEnv(outer_mt EnvType, binds_mt MalType, exprs_mt MalType) (EnvType, error) {
+	var env *Env
+	if outer_mt == nil {
+		env = &Env{vars: map[uint32]*Var{}}
+	} else if outer, ok := outer_mt.(*Env); ok {
+		env = &Env{outer: outer}
+	} else {
+		return nil, errors.New("outer environment is not an Env")
+	}
 
 	if binds_mt != nil && exprs_mt != nil {
 		binds, e := GetSlice(binds_mt)
@@ -28,38 +50,148 @@ func NewEnv(outer EnvType, binds_mt MalType, exprs_mt MalType) (EnvType, error)
 		}
 		// Return a new Env with symbols in binds boudn to
 		// corresponding values in exprs
+		variadic := false
 		for i := 0; i < len(binds); i += 1 {
 			if Symbol_Q(binds[i]) && binds[i].(Symbol).Val == "&" {
-				env.data[binds[i+1].(Symbol).Val] = List{exprs[i:], nil}
+				if i > len(exprs) {
+					return nil, arity_error(len(exprs))
+				}
+				env.Set(binds[i+1].(Symbol), List{Val: exprs[i:]})
+				variadic = true
 				break
+			} else if i >= len(exprs) {
+				return nil, arity_error(len(exprs))
 			} else {
-				env.data[binds[i].(Symbol).Val] = exprs[i]
+				env.Set(binds[i].(Symbol), exprs[i])
 			}
 		}
+		if !variadic && len(exprs) > len(binds) {
+			return nil, arity_error(len(exprs))
+		}
 	}
-	//return &et, nil
 	return env, nil
 }
 
-func (e Env) Find(key Symbol) EnvType {
-	if _, ok := e.data[key.Val]; ok {
-		return e
-	} else if e.outer != nil {
-		return e.outer.Find(key)
-	} else {
-		return nil
+func arity_error(n int) error {
+	return NewError("arity", fmt.Sprintf("wrong number of args (%d) passed to fn*", n))
+}
+
+// NewFrame makes a frame laid out in advance: vals[i] is the value of
+// the symbol with Id ids[i]. The ids slice is shared, not copied.
+func NewFrame(outer *Env, ids []uint32, vals []MalType) *Env {
+	return &Env{ids: ids, vals: vals, outer: outer}
+}
+
+// index finds a symbol in this frame, the latest binding first
+func (e *Env) index(key Symbol) int {
+	for i := len(e.ids) - 1; i >= 0; i -= 1 {
+		if e.ids[i] == key.Id {
+			return i
+		}
 	}
+	return -1
 }
 
-func (e Env) Set(key Symbol, value MalType) MalType {
-	e.data[key.Val] = value
+func (e *Env) Find(key Symbol) EnvType {
+	for env := e; env != nil; env = env.outer {
+		if env.vars != nil {
+			if v, ok := env.vars[key.Id]; ok && v.Bound {
+				return env
+			}
+		} else if env.index(key) >= 0 {
+			return env
+		}
+	}
+	return nil
+}
+
+func (e *Env) Set(key Symbol, value MalType) MalType {
+	if e.vars != nil {
+		e.Var(key).Set(value)
+	} else if i := e.index(key); i >= 0 {
+		e.vals[i] = value
+	} else {
+		// the ids may be shared with other frames: never append in
+		// place
+		e.ids = append(e.ids[:len(e.ids):len(e.ids)], key.Id)
+		e.vals = append(e.vals, value)
+	}
 	return value
 }
 
-func (e Env) Get(key Symbol) (MalType, error) {
-	env := e.Find(key)
-	if env == nil {
-		return nil, errors.New("'" + key.Val + "' not found")
+func (e *Env) Get(key Symbol) (MalType, error) {
+	for env := e; env != nil; env = env.outer {
+		if env.vars != nil {
+			if v, ok := env.vars[key.Id]; ok {
+				return v.Get()
+			}
+			break
+		} else if i := env.index(key); i >= 0 {
+			return env.vals[i], nil
+		}
 	}
-	return env.(Env).data[key.Val], nil
+	return nil, NewError("undefined-symbol", "'"+key.Val+"' not found")
+}
+
+// At returns the value at index of the frame depth levels out
+func (e *Env) At(depth int, index int) MalType {
+	for ; depth > 0; depth -= 1 {
+		e = e.outer
+	}
+	return e.vals[index]
+}
+
+func (e *Env) SetAt(index int, value MalType) {
+	e.vals[index] = value
+}
+
+// Copy makes a frame with the same layout and values as e, which can
+// then be changed without affecting e
+func (e *Env) Copy() *Env {
+	return &Env{ids: e.ids, vals: append([]MalType{}, e.vals...), outer: e.outer}
+}
+
+// Var returns the Var of a global, adding an unbound one if the
+// global is not defined yet
+func (e *Env) Var(key Symbol) *Var {
+	for e.outer != nil {
+		e = e.outer
+	}
+	v, ok := e.vars[key.Id]
+	if !ok {
+		v = &Var{Name: key.Val}
+		e.vars[key.Id] = v
+	}
+	return v
+}
+
+// LookupVar returns the Var of a global, or nil if it has none
+func (e *Env) LookupVar(key Symbol) *Var {
+	for e.outer != nil {
+		e = e.outer
+	}
+	return e.vars[key.Id]
+}
+
+// Vars returns the Vars of the globals, in no particular order
+func (e *Env) Vars() []*Var {
+	for e.outer != nil {
+		e = e.outer
+	}
+	vars := make([]*Var, 0, len(e.vars))
+	for _, v := range e.vars {
+		vars = append(vars, v)
+	}
+	return vars
+}
+
+func (v *Var) Get() (MalType, error) {
+	if !v.Bound {
+		return nil, NewError("undefined-symbol", "'"+v.Name+"' not found")
+	}
+	return v.Val, nil
+}
+
+func (v *Var) Set(value MalType) {
+	v.Val, v.Bound = value, true
 }
@@ -1,7 +1,6 @@
 package printer
 
 import (
-	"fmt"
 	"strings"
 )
 
@@ -18,45 +17,52 @@ func Pr_list(lst []types.MalType, pr bool,
 	return start + strings.Join(str_list, join) + end
 }
 
+// Pr_str prints containers and strings itself since print_readably
+// applies to their contents, every other type prints via its String
+// method
 func Pr_str(obj types.MalType, print_readably bool) string {
 	switch tobj := obj.(type) {
+	case nil:
+		return "nil"
 	case types.List:
-		return Pr_list(tobj.Val, print_readably, "(", ")", " ")
+		return Pr_list(tobj.Slice(), print_readably, "(", ")", " ")
 	case types.Vector:
 		return Pr_list(tobj.Val, print_readably, "[", "]", " ")
 	case types.HashMap:
-		str_list := make([]string, 0, len(tobj.Val)*2)
-		for k, v := range tobj.Val {
-			str_list = append(str_list, Pr_str(k, print_readably))
-			str_list = append(str_list, Pr_str(v, print_readably))
+		str_list := make([]string, 0, tobj.Count()*2)
+		for _, entry := range tobj.Entries() {
+			str_list = append(str_list, Pr_str(entry.Key, print_readably))
+			str_list = append(str_list, Pr_str(entry.Value, print_readably))
 		}
 		return "{" + strings.Join(str_list, " ") + "}"
-	case string:
-		if strings.HasPrefix(tobj, "\u029e") {
-			return ":" + tobj[2:len(tobj)]
-		} else if print_readably {
-			return `"` + strings.Replace(
-				strings.Replace(
-					strings.Replace(tobj, `\`, `\\`, -1),
-					`"`, `\"`, -1),
-				"\n", `\n`, -1) + `"`
+	case types.String:
+		if print_readably {
+			return tobj.String()
 		} else {
-			return tobj
+			return string(tobj)
 		}
-	case types.Symbol:
-		return tobj.Val
-	case nil:
-		return "nil"
-	case types.MalFunc:
-		return "(fn* " +
-			Pr_str(tobj.Params, true) + " " +
-			Pr_str(tobj.Exp, true) + ")"
-	case func([]types.MalType) (types.MalType, error):
-		return fmt.Sprintf("<function %v>", obj)
-	case *types.Atom:
-		return "(atom " +
-			Pr_str(tobj.Val, true) + ")"
+	case types.Regex:
+		if print_readably {
+			return tobj.String()
+		} else {
+			return tobj.Val.String()
+		}
+	case *types.ExInfo:
+		if tobj.Internal() {
+			return Pr_str(types.String(tobj.Message), print_readably)
+		}
+		str := "#error {:message " + Pr_str(types.String(tobj.Message), print_readably) +
+			" :data " + Pr_str(tobj.Data, print_readably)
+		if tobj.Cause != nil {
+			str += " :cause " + Pr_str(tobj.Cause, print_readably)
+		}
+		return str + "}"
+	case *types.TransientVector:
+		return "#<transient " +
+			Pr_list(tobj.Val, print_readably, "[", "]", " ") + ">"
+	case *types.TransientHashMap:
+		return "#<transient " + Pr_str(tobj.Val, print_readably) + ">"
 	default:
-		return fmt.Sprintf("%v", obj)
+		return obj.String()
 	}
 }
@@ -3,6 +3,7 @@ package reader
 import (
 	"errors"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	//"fmt"
@@ -15,11 +16,15 @@ import (
 type Reader interface {
 	next() *string
 	peek() *string
+	pos() *Pos
 }
 
 type TokenReader struct {
 	tokens   []string
 	position int
+	offsets  []int // where each token starts in the text
+	lines    []int // where each line starts in the text
+	source   string
 }
 
 func (tr *TokenReader) next() *string {
@@ -38,19 +43,42 @@ func (tr *TokenReader) peek() *string {
 	return &tr.tokens[tr.position]
 }
 
-func tokenize(str string) []string {
+// pos gives the line and column of the next token
+func (tr *TokenReader) pos() *Pos {
+	if tr.position >= len(tr.offsets) {
+		return nil
+	}
+	offset := tr.offsets[tr.position]
+	line := sort.SearchInts(tr.lines, offset+1) - 1
+	return &Pos{tr.source, line + 1, offset - tr.lines[line] + 1}
+}
+
+func tokenize(str string) ([]string, []int) {
 	results := make([]string, 0, 1)
+	offsets := make([]int, 0, 1)
 	// Work around lack of quoting in backtick
 	re := regexp.MustCompile(`[\s,]*(~@|[\[\]{}()'` + "`" +
-		`~^@]|"(?:\\.|[^\\"])*"?|;.*|[^\s\[\]{}('"` + "`" +
+		`~^@]|#?"(?:\\.|[^\\"])*"?|;.*|[^\s\[\]{}('"` + "`" +
 		`,;)]*)`)
-	for _, group := range re.FindAllStringSubmatch(str, -1) {
-		if (group[1] == "") || (group[1][0] == ';') {
+	for _, group := range re.FindAllStringSubmatchIndex(str, -1) {
+		token := str[group[2]:group[3]]
+		if (token == "") || (token[0] == ';') {
 			continue
 		}
-		results = append(results, group[1])
+		results = append(results, token)
+		offsets = append(offsets, group[2])
 	}
-	return results
+	return results, offsets
+}
+
+func line_starts(str string) []int {
+	lines := []int{0}
+	for i, c := range str {
+		if c == '\n' {
+			lines = append(lines, i+1)
+		}
+	}
+	return lines
 }
 
 func read_atom(rdr Reader) (MalType, error) {
@@ -64,34 +92,40 @@ func read_atom(rdr Reader) (MalType, error) {
 		if i, e = strconv.Atoi(*token); e != nil {
 			return nil, errors.New("number parse error")
 		}
-		return i, nil
+		return Int(i), nil
 	} else if match, _ :=
 		  regexp.MatchString(`^"(?:\\.|[^\\"])*"$`, *token); match {
 		str := (*token)[1 : len(*token)-1]
-		return strings.Replace(
+		return String(strings.Replace(
 			strings.Replace(
 			 strings.Replace(
 			  strings.Replace(str, `\\`, "\u029e", -1),
 			  `\"`, `"`, -1),
 			 `\n`, "\n", -1),
-			"\u029e", "\\", -1), nil
-	} else if (*token)[0] == '"' {
+			"\u029e", "\\", -1)), nil
+	} else if match, _ :=
+		  regexp.MatchString(`^#"(?:\\.|[^\\"])*"$`, *token); match {
+		// regex literals are passed to the regexp compiler as written,
+		// only the escaped closing quote needs undoing
+		pattern := (*token)[2 : len(*token)-1]
+		return NewRegex(strings.Replace(pattern, `\"`, `"`, -1))
+	} else if (*token)[0] == '"' || strings.HasPrefix(*token, `#"`) {
 		return nil, errors.New("expected '\"', got EOF")
 	} else if (*token)[0] == ':' {
 		return NewKeyword((*token)[1:len(*token)])
 	} else if *token == "nil" {
 		return nil, nil
 	} else if *token == "true" {
-		return true, nil
+		return Bool(true), nil
 	} else if *token == "false" {
-		return false, nil
+		return Bool(false), nil
 	} else {
-		return Symbol{*token}, nil
+		return NewSymbol(*token), nil
 	}
-	return token, nil
 }
 
 func read_list(rdr Reader, start string, end string) (MalType, error) {
+	pos := rdr.pos()
 	token := rdr.next()
 	if token == nil {
 		return nil, errors.New("read_list underflow")
@@ -116,7 +150,7 @@ func read_list(rdr Reader, start string, end string) (MalType, error) {
 		ast_list = append(ast_list, f)
 	}
 	rdr.next()
-	return List{ast_list, nil}, nil
+	return List{Val: ast_list, Pos: pos}, nil
 }
 
 func read_vector(rdr Reader) (MalType, error) {
@@ -136,6 +170,61 @@ func read_hash_map(rdr Reader) (MalType, error) {
 	return NewHashMap(mal_lst)
 }
 
+// read_meta reads a ^ form: the metadata, and the form it is attached
+// to at read time. ^:flag is shorthand for {:flag true}, and ^"tag" for
+// {:tag "tag"}. The metadata of ^ forms stacked on the form is
+// merged, the outer one taking precedence.
+func read_meta(rdr Reader) (MalType, MalType, error) {
+	rdr.next()
+	meta, e := read_form(rdr)
+	if e != nil {
+		return nil, nil, e
+	}
+	switch meta.(type) {
+	case Keyword:
+		meta = HashMap{}.AssocAll(meta, Bool(true))
+	case String:
+		meta = HashMap{}.AssocAll(Keyword("tag"), meta)
+	}
+	if token := rdr.peek(); token == nil || *token != "^" {
+		form, e := read_form(rdr)
+		return form, meta, e
+	}
+	form, inner, e := read_meta(rdr)
+	if e != nil {
+		return nil, nil, e
+	}
+	outer, ok := meta.(HashMap)
+	merged, inner_ok := inner.(HashMap)
+	if !ok || !inner_ok {
+		return form, meta, nil
+	}
+	for _, entry := range outer.Entries() {
+		merged = merged.AssocAll(entry.Key, entry.Value)
+	}
+	return form, merged, nil
+}
+
+// with_meta gives the form read for a ^ form: (with-meta form meta),
+// form carrying the metadata too, as the name of a def! does
+func with_meta(form MalType, meta MalType) MalType {
+	switch tform := form.(type) {
+	case Symbol:
+		tform.Meta = meta
+		form = tform
+	case List:
+		tform.Meta = meta
+		form = tform
+	case Vector:
+		tform.Meta = meta
+		form = tform
+	case HashMap:
+		tform.Meta = meta
+		form = tform
+	}
+	return List{Val: []MalType{NewSymbol("with-meta"), form, meta}}
+}
+
 func read_form(rdr Reader) (MalType, error) {
 	token := rdr.peek()
 	if token == nil {
@@ -149,46 +238,41 @@ func read_form(rdr Reader) (MalType, error) {
 		if e != nil {
 			return nil, e
 		}
-		return List{[]MalType{Symbol{"quote"}, form}, nil}, nil
+		return List{Val: []MalType{NewSymbol("quote"), form}}, nil
 	case "`":
 		rdr.next()
 		form, e := read_form(rdr)
 		if e != nil {
 			return nil, e
 		}
-		return List{[]MalType{Symbol{"quasiquote"}, form}, nil}, nil
+		return List{Val: []MalType{NewSymbol("quasiquote"), form}}, nil
 	case `~`:
 		rdr.next()
 		form, e := read_form(rdr)
 		if e != nil {
 			return nil, e
 		}
-		return List{[]MalType{Symbol{"unquote"}, form}, nil}, nil
+		return List{Val: []MalType{NewSymbol("unquote"), form}}, nil
 	case `~@`:
 		rdr.next()
 		form, e := read_form(rdr)
 		if e != nil {
 			return nil, e
 		}
-		return List{[]MalType{Symbol{"splice-unquote"}, form}, nil}, nil
+		return List{Val: []MalType{NewSymbol("splice-unquote"), form}}, nil
 	case `^`:
-		rdr.next()
-		meta, e := read_form(rdr)
-		if e != nil {
-			return nil, e
-		}
-		form, e := read_form(rdr)
+		form, meta, e := read_meta(rdr)
 		if e != nil {
 			return nil, e
 		}
-		return List{[]MalType{Symbol{"with-meta"}, form, meta}, nil}, nil
+		return with_meta(form, meta), nil
 	case `@`:
 		rdr.next()
 		form, e := read_form(rdr)
 		if e != nil {
 			return nil, e
 		}
-		return List{[]MalType{Symbol{"deref"}, form}, nil}, nil
+		return List{Val: []MalType{NewSymbol("deref"), form}}, nil
 
 	// list
 	case ")":
@@ -214,10 +298,28 @@ func read_form(rdr Reader) (MalType, error) {
 }
 
 func Read_str(str string) (MalType, error) {
-	var tokens = tokenize(str)
+	var tokens, offsets = tokenize(str)
 	if len(tokens) == 0 {
 		return nil, errors.New("<empty line>")
 	}
 
-	return read_form(&TokenReader{tokens: tokens, position: 0})
+	return read_form(&TokenReader{tokens: tokens, position: 0,
+		offsets: offsets, lines: line_starts(str)})
+}
+
+// Read_source reads all the forms of a file into a do form ending with
+// nil. The positions of the lists read name the file as their source.
+func Read_source(str string, source string) (MalType, error) {
+	var tokens, offsets = tokenize(str)
+	rdr := &TokenReader{tokens: tokens, position: 0,
+		offsets: offsets, lines: line_starts(str), source: source}
+	forms := []MalType{NewSymbol("do")}
+	for rdr.peek() != nil {
+		form, e := read_form(rdr)
+		if e != nil {
+			return nil, e
+		}
+		forms = append(forms, form)
+	}
+	return List{Val: append(forms, nil)}, nil
 }
@@ -28,18 +28,18 @@ func PRINT(exp MalType) (string, error) {
 }
 
 // repl
-func rep(str string) (MalType, error) {
+func rep(str string) (string, error) {
 	var exp MalType
 	var res string
 	var e error
 	if exp, e = READ(str); e != nil {
-		return nil, e
+		return "", e
 	}
 	if exp, e = EVAL(exp, ""); e != nil {
-		return nil, e
+		return "", e
 	}
 	if res, e = PRINT(exp); e != nil {
-		return nil, e
+		return "", e
 	}
 	return res, nil
 }
@@ -52,7 +52,7 @@ func main() {
 		if err != nil {
 			return
 		}
-		var out MalType
+		var out string
 		var e error
 		if out, e = rep(text); e != nil {
 			if e.Error() == "<empty line>" {
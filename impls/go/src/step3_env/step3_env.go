@@ -26,14 +26,14 @@ func eval_ast(ast MalType, env EnvType) (MalType, error) {
 		return env.Get(ast.(Symbol))
 	} else if List_Q(ast) {
 		lst := []MalType{}
-		for _, a := range ast.(List).Val {
+		for _, a := range ast.(List).Slice() {
 			exp, e := EVAL(a, env)
 			if e != nil {
 				return nil, e
 			}
 			lst = append(lst, exp)
 		}
-		return List{lst, nil}, nil
+		return List{Val: lst}, nil
 	} else if Vector_Q(ast) {
 		lst := []MalType{}
 		for _, a := range ast.(Vector).Val {
@@ -46,15 +46,19 @@ func eval_ast(ast MalType, env EnvType) (MalType, error) {
 		return Vector{lst, nil}, nil
 	} else if HashMap_Q(ast) {
 		m := ast.(HashMap)
-		new_hm := HashMap{map[string]MalType{}, nil}
-		for k, v := range m.Val {
-			kv, e2 := EVAL(v, env)
+		kvs := make([]MalType, 0, 2*m.Count())
+		for _, entry := range m.Entries() {
+			k, e2 := EVAL(entry.Key, env)
 			if e2 != nil {
 				return nil, e2
 			}
-			new_hm.Val[k] = kv
+			kv, e2 := EVAL(entry.Value, env)
+			if e2 != nil {
+				return nil, e2
+			}
+			kvs = append(kvs, k, kv)
 		}
-		return new_hm, nil
+		return HashMap{}.AssocAll(kvs...), nil
 	} else {
 		return ast, nil
 	}
@@ -68,24 +72,24 @@ func EVAL(ast MalType, env EnvType) (MalType, error) {
 		return eval_ast(ast, env)
 	}
 
-	if len(ast.(List).Val) == 0 {
+	if ast.(List).Count() == 0 {
 		return ast, nil
 	}
 
 	// apply list
-	a0 := ast.(List).Val[0]
+	a0 := ast.(List).Slice()[0]
 	var a1 MalType = nil
 	var a2 MalType = nil
-	switch len(ast.(List).Val) {
+	switch ast.(List).Count() {
 	case 1:
 		a1 = nil
 		a2 = nil
 	case 2:
-		a1 = ast.(List).Val[1]
+		a1 = ast.(List).Slice()[1]
 		a2 = nil
 	default:
-		a1 = ast.(List).Val[1]
-		a2 = ast.(List).Val[2]
+		a1 = ast.(List).Slice()[1]
+		a2 = ast.(List).Slice()[2]
 	}
 	a0sym := "__<*fn*>__"
 	if Symbol_Q(a0) {
@@ -123,11 +127,11 @@ func EVAL(ast MalType, env EnvType) (MalType, error) {
 		if e != nil {
 			return nil, e
 		}
-		f, ok := el.(List).Val[0].(func([]MalType) (MalType, error))
+		f, ok := el.(List).Slice()[0].(*Func)
 		if !ok {
 			return nil, errors.New("attempt to call non-function")
 		}
-		return f(el.(List).Val[1:])
+		return f.Fn(el.(List).Slice()[1:])
 	}
 }
 
@@ -139,47 +143,47 @@ func PRINT(exp MalType) (string, error) {
 var repl_env, _ = NewEnv(nil, nil, nil)
 
 // repl
-func rep(str string) (MalType, error) {
+func rep(str string) (string, error) {
 	var exp MalType
 	var res string
 	var e error
 	if exp, e = READ(str); e != nil {
-		return nil, e
+		return "", e
 	}
 	if exp, e = EVAL(exp, repl_env); e != nil {
-		return nil, e
+		return "", e
 	}
 	if res, e = PRINT(exp); e != nil {
-		return nil, e
+		return "", e
 	}
 	return res, nil
 }
 
 func main() {
-	repl_env.Set(Symbol{"+"}, func(a []MalType) (MalType, error) {
+	repl_env.Set(NewSymbol("+"), &Func{func(a []MalType) (MalType, error) {
 		if e := assertArgNum(a, 2); e != nil {
 			return nil, e
 		}
-		return a[0].(int) + a[1].(int), nil
-	})
-	repl_env.Set(Symbol{"-"}, func(a []MalType) (MalType, error) {
+		return a[0].(Int) + a[1].(Int), nil
+	}, nil})
+	repl_env.Set(NewSymbol("-"), &Func{func(a []MalType) (MalType, error) {
 		if e := assertArgNum(a, 2); e != nil {
 			return nil, e
 		}
-		return a[0].(int) - a[1].(int), nil
-	})
-	repl_env.Set(Symbol{"*"}, func(a []MalType) (MalType, error) {
+		return a[0].(Int) - a[1].(Int), nil
+	}, nil})
+	repl_env.Set(NewSymbol("*"), &Func{func(a []MalType) (MalType, error) {
 		if e := assertArgNum(a, 2); e != nil {
 			return nil, e
 		}
-		return a[0].(int) * a[1].(int), nil
-	})
-	repl_env.Set(Symbol{"/"}, func(a []MalType) (MalType, error) {
+		return a[0].(Int) * a[1].(Int), nil
+	}, nil})
+	repl_env.Set(NewSymbol("/"), &Func{func(a []MalType) (MalType, error) {
 		if e := assertArgNum(a, 2); e != nil {
 			return nil, e
 		}
-		return a[0].(int) / a[1].(int), nil
-	})
+		return a[0].(Int) / a[1].(Int), nil
+	}, nil})
 
 	// repl loop
 	for {
@@ -188,7 +192,7 @@ func main() {
 		if err != nil {
 			return
 		}
-		var out MalType
+		var out string
 		var e error
 		if out, e = rep(text); e != nil {
 			if e.Error() == "<empty line>" {
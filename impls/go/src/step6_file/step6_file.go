@@ -28,14 +28,14 @@ func eval_ast(ast MalType, env EnvType) (MalType, error) {
 		return env.Get(ast.(Symbol))
 	} else if List_Q(ast) {
 		lst := []MalType{}
-		for _, a := range ast.(List).Val {
+		for _, a := range ast.(List).Slice() {
 			exp, e := EVAL(a, env)
 			if e != nil {
 				return nil, e
 			}
 			lst = append(lst, exp)
 		}
-		return List{lst, nil}, nil
+		return List{Val: lst}, nil
 	} else if Vector_Q(ast) {
 		lst := []MalType{}
 		for _, a := range ast.(Vector).Val {
@@ -48,15 +48,19 @@ func eval_ast(ast MalType, env EnvType) (MalType, error) {
 		return Vector{lst, nil}, nil
 	} else if HashMap_Q(ast) {
 		m := ast.(HashMap)
-		new_hm := HashMap{map[string]MalType{}, nil}
-		for k, v := range m.Val {
-			kv, e2 := EVAL(v, env)
+		kvs := make([]MalType, 0, 2*m.Count())
+		for _, entry := range m.Entries() {
+			k, e2 := EVAL(entry.Key, env)
 			if e2 != nil {
 				return nil, e2
 			}
-			new_hm.Val[k] = kv
+			kv, e2 := EVAL(entry.Value, env)
+			if e2 != nil {
+				return nil, e2
+			}
+			kvs = append(kvs, k, kv)
 		}
-		return new_hm, nil
+		return HashMap{}.AssocAll(kvs...), nil
 	} else {
 		return ast, nil
 	}
@@ -72,24 +76,24 @@ func EVAL(ast MalType, env EnvType) (MalType, error) {
 			return eval_ast(ast, env)
 		}
 
-		if len(ast.(List).Val) == 0 {
+		if ast.(List).Count() == 0 {
 			return ast, nil
 		}
 
 		// apply list
-		a0 := ast.(List).Val[0]
+		a0 := ast.(List).Slice()[0]
 		var a1 MalType = nil
 		var a2 MalType = nil
-		switch len(ast.(List).Val) {
+		switch ast.(List).Count() {
 		case 1:
 			a1 = nil
 			a2 = nil
 		case 2:
-			a1 = ast.(List).Val[1]
+			a1 = ast.(List).Slice()[1]
 			a2 = nil
 		default:
-			a1 = ast.(List).Val[1]
-			a2 = ast.(List).Val[2]
+			a1 = ast.(List).Slice()[1]
+			a2 = ast.(List).Slice()[2]
 		}
 		a0sym := "__<*fn*>__"
 		if Symbol_Q(a0) {
@@ -124,8 +128,8 @@ func EVAL(ast MalType, env EnvType) (MalType, error) {
 			ast = a2
 			env = let_env
 		case "do":
-			lst := ast.(List).Val
-			_, e := eval_ast(List{lst[1 : len(lst)-1], nil}, env)
+			lst := ast.(List).Slice()
+			_, e := eval_ast(List{Val: lst[1 : len(lst)-1]}, env)
 			if e != nil {
 				return nil, e
 			}
@@ -138,9 +142,9 @@ func EVAL(ast MalType, env EnvType) (MalType, error) {
 			if e != nil {
 				return nil, e
 			}
-			if cond == nil || cond == false {
-				if len(ast.(List).Val) >= 4 {
-					ast = ast.(List).Val[3]
+			if cond == nil || cond == Bool(false) {
+				if ast.(List).Count() >= 4 {
+					ast = ast.(List).Slice()[3]
 				} else {
 					return nil, nil
 				}
@@ -148,27 +152,27 @@ func EVAL(ast MalType, env EnvType) (MalType, error) {
 				ast = a2
 			}
 		case "fn*":
-			fn := MalFunc{EVAL, a2, env, a1, false, NewEnv, nil}
+			fn := &MalFunc{EVAL, a2, env, a1, false, NewEnv, nil}
 			return fn, nil
 		default:
 			el, e := eval_ast(ast, env)
 			if e != nil {
 				return nil, e
 			}
-			f := el.(List).Val[0]
+			f := el.(List).Slice()[0]
 			if MalFunc_Q(f) {
-				fn := f.(MalFunc)
+				fn := f.(*MalFunc)
 				ast = fn.Exp
-				env, e = NewEnv(fn.Env, fn.Params, List{el.(List).Val[1:], nil})
+				env, e = NewEnv(fn.Env, fn.Params, List{Val: el.(List).Slice()[1:]})
 				if e != nil {
 					return nil, e
 				}
 			} else {
-				fn, ok := f.(Func)
+				fn, ok := f.(*Func)
 				if !ok {
 					return nil, errors.New("attempt to call non-function")
 				}
-				return fn.Fn(el.(List).Val[1:])
+				return fn.Fn(el.(List).Slice()[1:])
 			}
 		}
 
@@ -183,18 +187,18 @@ func PRINT(exp MalType) (string, error) {
 var repl_env, _ = NewEnv(nil, nil, nil)
 
 // repl
-func rep(str string) (MalType, error) {
+func rep(str string) (string, error) {
 	var exp MalType
 	var res string
 	var e error
 	if exp, e = READ(str); e != nil {
-		return nil, e
+		return "", e
 	}
 	if exp, e = EVAL(exp, repl_env); e != nil {
-		return nil, e
+		return "", e
 	}
 	if res, e = PRINT(exp); e != nil {
-		return nil, e
+		return "", e
 	}
 	return res, nil
 }
@@ -202,12 +206,12 @@ func rep(str string) (MalType, error) {
 func main() {
 	// core.go: defined using go
 	for k, v := range core.NS {
-		repl_env.Set(Symbol{k}, Func{v.(func([]MalType) (MalType, error)), nil})
+		repl_env.Set(NewSymbol(k), &Func{v, nil})
 	}
-	repl_env.Set(Symbol{"eval"}, Func{func(a []MalType) (MalType, error) {
+	repl_env.Set(NewSymbol("eval"), &Func{func(a []MalType) (MalType, error) {
 		return EVAL(a[0], repl_env)
 	}, nil})
-	repl_env.Set(Symbol{"*ARGV*"}, List{})
+	repl_env.Set(NewSymbol("*ARGV*"), List{})
 
 	// core.mal: defined using the language itself
 	rep("(def! not (fn* (a) (if a false true)))")
@@ -217,9 +221,9 @@ func main() {
 	if len(os.Args) > 1 {
 		args := make([]MalType, 0, len(os.Args)-2)
 		for _, a := range os.Args[2:] {
-			args = append(args, a)
+			args = append(args, String(a))
 		}
-		repl_env.Set(Symbol{"*ARGV*"}, List{args, nil})
+		repl_env.Set(NewSymbol("*ARGV*"), List{Val: args})
 		if _, e := rep("(load-file \"" + os.Args[1] + "\")"); e != nil {
 			fmt.Printf("Error: %v\n", e)
 			os.Exit(1)
@@ -234,7 +238,7 @@ func main() {
 		if err != nil {
 			return
 		}
-		var out MalType
+		var out string
 		var e error
 		if out, e = rep(text); e != nil {
 			if e.Error() == "<empty line>" {
@@ -0,0 +1,784 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+import (
+	. "mal/src/env"
+	. "mal/src/types"
+)
+
+// Compiler from mal forms to bytecode for the VM in vm.go. Each fn*
+// becomes a proto; locals live in stack slots, and locals that inner
+// functions capture live in cells shared with their closures.
+
+// Opcodes. All but OP_POP, OP_RETURN, OP_CAUGHT and OP_RETHROW are
+// followed by one 16-bit big-endian operand.
+const (
+	OP_CONST         byte = iota // k: push consts[k]
+	OP_GET_LOCAL                 // s: push local s
+	OP_SET_LOCAL                 // s: pop into local s
+	OP_INIT_LOCAL                // s: no-op, OP_NEW_CELL once s is captured
+	OP_INIT_PARAM                // s: no-op, OP_BOX once s is captured
+	OP_GET_CELL                  // s: push the value in the cell of local s
+	OP_SET_CELL                  // s: pop into the cell of local s
+	OP_NEW_CELL                  // s: give local s an empty cell
+	OP_BOX                       // s: move the value of local s into a cell
+	OP_GET_UPVAL                 // u: push the value of upvalue u
+	OP_GET_GLOBAL                // v: push the value of vars[v]
+	OP_DEF_GLOBAL                // v: set vars[v] to the top value
+	OP_DEF_MACRO                 // v: as OP_DEF_GLOBAL, making it a macro
+	OP_POP                       // drop the top value
+	OP_JUMP                      // a: continue at a
+	OP_JUMP_IF_FALSE             // a: pop, continue at a if nil or false
+	OP_CALL                      // n: call the function below n arguments
+	OP_TAIL_CALL                 // n: as OP_CALL, reusing the frame
+	OP_GET_CALLEE                // c: push the global called at sites[c], or expand the call if a macro
+	OP_CHECK_CALLEE              // c: expand the call at sites[c] if the top value is a macro
+	OP_EXPANDED                  // c: compile the call at sites[c] again once its macro is redefined
+	OP_RETURN                    // return the top value
+	OP_CLOSURE                   // p: push a closure of protos[p]
+	OP_ARITIES                   // k: pop a closure for each clause of the fn* consts[k], push the function
+	OP_VECTOR                    // n: pop n values into a vector
+	OP_HASH_MAP                  // n: pop n keys and values into a map
+	OP_FAIL                      // e: raise errs[e]
+	OP_CATCHES                   // k: push whether catch* tag consts[k] takes the exception on top
+	OP_CAUGHT                    // replace the exception on top by its value
+	OP_RETHROW                   // pop an exception and raise it again
+)
+
+// the ops that change when the local they refer to is captured
+var cell_ops = map[byte]byte{
+	OP_GET_LOCAL:  OP_GET_CELL,
+	OP_SET_LOCAL:  OP_SET_CELL,
+	OP_INIT_LOCAL: OP_NEW_CELL,
+	OP_INIT_PARAM: OP_BOX,
+}
+
+func has_operand(op byte) bool {
+	return op != OP_POP && op != OP_RETURN && op != OP_CAUGHT && op != OP_RETHROW
+}
+
+type proto struct {
+	name     string // for stack traces
+	code     []byte
+	consts   []MalType
+	vars     []*Var
+	protos   []*proto
+	sites    []*vm_site
+	errs     []error
+	handlers []handler
+	calls    []call_span
+	upvals   []upval_ref
+	ids      []uint32 // the symbol Ids of the upvalues
+	nparams  int
+	variadic bool
+	nlocals  int
+	params   MalType
+	body     MalType
+	globals  *Env
+}
+
+// handler is an entry of the exception table of a proto: errors raised
+// by the code in (start, end] continue at target, with the stack cut
+// back to depth values above the locals and the exception pushed. The
+// first entry covering an error takes it, so inner handlers come first.
+type handler struct {
+	start, end, target, depth int
+}
+
+// call_span says which call the code from ip on is part of, up to the
+// next call_span, for stack traces. form is nil outside any call.
+type call_span struct {
+	ip   int
+	form MalType
+	pos  *Pos
+}
+
+// call_at finds the call the op ending at ip is part of
+func (p *proto) call_at(ip int) *call_span {
+	for i := len(p.calls) - 1; i >= 0; i -= 1 {
+		if p.calls[i].ip < ip {
+			return &p.calls[i]
+		}
+	}
+	return nil
+}
+
+// upval_ref says where a closure takes an upvalue from when it is
+// created: a local of the enclosing function, or one of its upvalues.
+// With copy set, the local is not in a cell, and the closure gets a
+// new cell with its value (see resume).
+type upval_ref struct {
+	local bool
+	index int
+	copy  bool
+}
+
+type local struct {
+	id       uint32
+	slot     int
+	visible  bool
+	captured bool
+	fixed    bool  // compiled before, so it cannot be captured any more
+	sites    []int // the ops using slot, to patch when captured
+}
+
+type compiler struct {
+	p      *proto
+	parent *compiler
+	locals []*local
+	depth  int // values on the stack above the locals
+	err    error
+	pos    *Pos // of the innermost list read with a position
+	call   call_span
+	loop   *vm_loop  // the innermost loop* or fn*, nil at top level
+	fixed  bool      // compiling more code for a proto already running
+	outer  *snapshot // of the parent, once a site needs it
+}
+
+// vm_loop is a loop* or function body, which a recur in tail position
+// jumps back to the start of with new values in locals
+type vm_loop struct {
+	start  int
+	locals []*local
+	depth  int
+	// whether the loop* is in tail position of its function, so that
+	// calls in tail position of the body are tail calls
+	tail bool
+}
+
+func (c *compiler) tail_calls() bool {
+	return c.loop == nil || c.loop.tail
+}
+
+// in_call marks the code emitted from now on as part of a call
+func (c *compiler) in_call(form MalType, pos *Pos) {
+	c.call = call_span{len(c.p.code), form, pos}
+	c.p.calls = append(c.p.calls, c.call)
+}
+
+func compile_proto(ast MalType, env *Env) (*proto, error) {
+	c := &compiler{p: &proto{body: ast, globals: env}}
+	c.compile(ast, true)
+	c.emit(OP_RETURN, -1)
+	return c.p, c.err
+}
+
+func (c *compiler) emit(op byte, effect int, args ...int) int {
+	pos := len(c.p.code)
+	c.p.code = append(c.p.code, op)
+	for _, a := range args {
+		if a > 0xffff && c.err == nil {
+			c.err = errors.New("function too large to compile")
+		}
+		c.p.code = append(c.p.code, byte(a>>8), byte(a))
+	}
+	c.depth += effect
+	return pos
+}
+
+// patch sets the operand of the op at pos
+func (c *compiler) patch(pos int, a int) {
+	if a > 0xffff && c.err == nil {
+		c.err = errors.New("function too large to compile")
+	}
+	c.p.code[pos+1], c.p.code[pos+2] = byte(a>>8), byte(a)
+}
+
+func (c *compiler) global(sym Symbol) int {
+	c.p.vars = append(c.p.vars, global_var(c.p.globals, sym))
+	return len(c.p.vars) - 1
+}
+
+func (c *compiler) constant(obj MalType) {
+	c.p.consts = append(c.p.consts, obj)
+	c.emit(OP_CONST, 1, len(c.p.consts)-1)
+}
+
+// fail compiles raising an error, so that errors found while compiling
+// happen when the form is run, where try* can catch them
+func (c *compiler) fail(e error) {
+	c.p.errs = append(c.p.errs, e)
+	c.emit(OP_FAIL, 1, len(c.p.errs)-1)
+}
+
+// reject is fail for errors that keep the whole top-level form from
+// being run
+func (c *compiler) reject(e error) {
+	if c.err == nil {
+		c.err = e
+	}
+	c.fail(e)
+}
+
+func (c *compiler) declare(sym Symbol, visible bool) *local {
+	l := &local{id: sym.Id, slot: c.p.nlocals, visible: visible}
+	c.p.nlocals += 1
+	c.locals = append(c.locals, l)
+	return l
+}
+
+func (c *compiler) emit_local(op byte, effect int, l *local) {
+	if l.captured {
+		op = cell_ops[op]
+	}
+	l.sites = append(l.sites, c.emit(op, effect, l.slot))
+}
+
+func (c *compiler) capture(l *local) {
+	if l.captured {
+		return
+	}
+	l.captured = true
+	for _, pos := range l.sites {
+		c.p.code[pos] = cell_ops[c.p.code[pos]]
+	}
+}
+
+// find_local looks sym up among the locals of c. Bindings of a let*
+// still being compiled are only found when pending is set, which is
+// for inner functions: like in a let* environment, functions created
+// while evaluating a binding see all of them.
+func (c *compiler) find_local(sym Symbol, pending bool) *local {
+	for i := len(c.locals) - 1; i >= 0; i -= 1 {
+		l := c.locals[i]
+		if l.id == sym.Id && (l.visible || pending) {
+			return l
+		}
+	}
+	return nil
+}
+
+// upvalue gives the index of the upvalue for sym, adding it when an
+// enclosing function has it as a local
+func (c *compiler) upvalue(sym Symbol) (int, bool) {
+	for i, id := range c.p.ids {
+		if id == sym.Id {
+			return i, true
+		}
+	}
+	if c.parent == nil || c.fixed {
+		return 0, false
+	}
+	var ref upval_ref
+	if l := c.parent.find_local(sym, true); l != nil && l.fixed && !l.captured {
+		ref = upval_ref{true, l.slot, true}
+	} else if l != nil {
+		c.parent.capture(l)
+		ref = upval_ref{true, l.slot, false}
+	} else if u, ok := c.parent.upvalue(sym); ok {
+		ref = upval_ref{false, u, false}
+	} else {
+		return 0, false
+	}
+	c.p.ids = append(c.p.ids, sym.Id)
+	c.p.upvals = append(c.p.upvals, ref)
+	return len(c.p.upvals) - 1, true
+}
+
+func (c *compiler) is_local(sym Symbol) bool {
+	if c.find_local(sym, false) != nil {
+		return true
+	}
+	for fc := c.parent; fc != nil; fc = fc.parent {
+		if fc.find_local(sym, true) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// local_ids gives the Ids of the symbols is_local finds at this point
+func (c *compiler) local_ids() map[uint32]bool {
+	ids := map[uint32]bool{}
+	for _, l := range c.locals {
+		if l.visible {
+			ids[l.id] = true
+		}
+	}
+	for fc := c.parent; fc != nil; fc = fc.parent {
+		for _, l := range fc.locals {
+			ids[l.id] = true
+		}
+	}
+	return ids
+}
+
+func (c *compiler) compile(ast MalType, tail bool) {
+	switch a := ast.(type) {
+	case Symbol:
+		c.compile_symbol(a)
+	case Vector:
+		for _, x := range a.Val {
+			c.compile(x, false)
+		}
+		c.emit(OP_VECTOR, 1-len(a.Val), len(a.Val))
+	case HashMap:
+		for _, entry := range a.Entries() {
+			c.compile(entry.Key, false)
+			c.compile(entry.Value, false)
+		}
+		c.emit(OP_HASH_MAP, 1-2*a.Count(), a.Count())
+	case List:
+		if a.Count() == 0 {
+			c.constant(ast)
+			return
+		}
+		if a.Pos != nil {
+			defer func(pos *Pos) { c.pos = pos }(c.pos)
+			c.pos = a.Pos
+		}
+		c.compile_list(a, tail)
+	default:
+		c.constant(ast)
+	}
+}
+
+func (c *compiler) compile_symbol(sym Symbol) {
+	if l := c.find_local(sym, false); l != nil {
+		c.emit_local(OP_GET_LOCAL, 1, l)
+	} else if u, ok := c.upvalue(sym); ok {
+		c.emit(OP_GET_UPVAL, 1, u)
+	} else if c.is_local(sym) {
+		// code compiled at run time cannot add upvalues to its closure
+		c.fail(NewError("syntax", sym.Val+" of an enclosing function is out of reach of code expanded at run time"))
+		return
+	} else {
+		c.emit(OP_GET_GLOBAL, 1, c.global(sym))
+	}
+}
+
+func (c *compiler) compile_list(form List, tail bool) {
+	lst := form.Slice()
+	var a1 MalType = nil
+	var a2 MalType = nil
+	switch len(lst) {
+	case 1:
+	case 2:
+		a1 = lst[1]
+	default:
+		a1 = lst[1]
+		a2 = lst[2]
+	}
+	a0sym := "__<*fn*>__"
+	if Symbol_Q(lst[0]) {
+		a0sym = lst[0].(Symbol).Val
+	}
+	switch a0sym {
+	case "def!", "defmacro!":
+		sym, ok := def_name(a1)
+		if !ok {
+			c.fail(NewError("syntax", a0sym+" requires a symbol"))
+			return
+		}
+		// the Var is made first, so that a function can call itself
+		v, e := define_var(c.p.globals, sym)
+		if e != nil {
+			c.fail(e)
+			return
+		}
+		c.p.vars = append(c.p.vars, v)
+		idx := len(c.p.vars) - 1
+		c.compile_init(a2, sym, a0sym == "defmacro!")
+		if a0sym == "def!" {
+			c.emit(OP_DEF_GLOBAL, 0, idx)
+		} else {
+			c.emit(OP_DEF_MACRO, 0, idx)
+		}
+	case "let*":
+		c.compile_let(a1, a2, tail)
+	case "loop*":
+		c.compile_loop(a1, a2, tail)
+	case "recur":
+		c.compile_recur(lst[1:], tail)
+	case "quote":
+		c.constant(a1)
+	case "quasiquote":
+		c.compile(quasiquote(a1, c.p.globals), tail)
+	case "try*":
+		c.compile_try(a1, lst[min(2, len(lst)):], tail)
+	case "do":
+		if len(lst) == 1 {
+			c.constant(nil)
+			return
+		}
+		for _, x := range lst[1 : len(lst)-1] {
+			c.compile(x, false)
+			c.emit(OP_POP, -1)
+		}
+		c.compile(lst[len(lst)-1], tail)
+	case "if":
+		c.compile(a1, false)
+		jump_else := c.emit(OP_JUMP_IF_FALSE, -1, 0)
+		c.compile(a2, tail)
+		jump_end := c.emit(OP_JUMP, -1, 0)
+		c.patch(jump_else, len(c.p.code))
+		if len(lst) >= 4 {
+			c.compile(lst[3], tail)
+		} else {
+			c.constant(nil)
+		}
+		c.patch(jump_end, len(c.p.code))
+	case "fn*":
+		c.compile_fn(lst[1:], "fn*", false)
+	case "macroexpand-1", "macroexpand", "macroexpand-all":
+		x := &expander{c.p.globals, c.local_ids()}
+		c.constant(&Func{Fn: func([]MalType) (MalType, error) { return x.macroexpand(a0sym, a1) }})
+		c.emit(OP_CALL, 0, 0)
+	default:
+		c.compile_call(form, tail)
+	}
+}
+
+// compile_bindings compiles the bindings of a let* or loop*, leaving
+// their locals declared. It fails unless they are well formed.
+func (c *compiler) compile_bindings(a1 MalType) bool {
+	binds, e := GetSlice(a1)
+	if e == nil {
+		binds, e = destructure(binds)
+	}
+	if e != nil {
+		c.fail(e)
+		return false
+	}
+	n := len(c.locals)
+	for i := 0; i < len(binds); i += 2 {
+		sym, ok := binds[i].(Symbol)
+		if !ok {
+			c.locals = c.locals[:n]
+			c.fail(NewError("syntax", "non-symbol bind value"))
+			return false
+		}
+		c.emit_local(OP_INIT_LOCAL, 0, c.declare(sym, false))
+	}
+	for i := 0; i < len(binds); i += 2 {
+		var init MalType = nil
+		if i+1 < len(binds) {
+			init = binds[i+1]
+		}
+		c.compile_init(init, binds[i].(Symbol), false)
+		l := c.locals[n+i/2]
+		c.emit_local(OP_SET_LOCAL, -1, l)
+		l.visible = true
+	}
+	return true
+}
+
+func (c *compiler) compile_let(a1 MalType, a2 MalType, tail bool) {
+	n := len(c.locals)
+	if !c.compile_bindings(a1) {
+		return
+	}
+	c.compile(a2, tail)
+	c.locals = c.locals[:n]
+}
+
+func (c *compiler) compile_loop(a1 MalType, a2 MalType, tail bool) {
+	if binds, e := GetSlice(a1); e == nil {
+		if form, ok := destructure_loop(binds, a2); ok {
+			c.compile(form, tail)
+			return
+		}
+	}
+	n := len(c.locals)
+	if !c.compile_bindings(a1) {
+		return
+	}
+	outer := c.loop
+	c.loop = &vm_loop{len(c.p.code), append([]*local{}, c.locals[n:]...), c.depth, tail && c.tail_calls()}
+	c.compile(a2, true)
+	c.loop = outer
+	c.locals = c.locals[:n]
+}
+
+// compile_recur sets the locals of the loop from the values of args,
+// in fresh cells for those captured, and jumps back
+func (c *compiler) compile_recur(args []MalType, tail bool) {
+	t := c.loop
+	switch {
+	case t == nil:
+		c.reject(NewError("syntax", "recur outside of loop* or fn*"))
+		return
+	case !tail:
+		c.reject(NewError("syntax", "recur must be in tail position"))
+		return
+	case len(args) != len(t.locals):
+		c.reject(NewError("arity", fmt.Sprintf("recur: wrong number of arguments (%d instead of %d)", len(args), len(t.locals))))
+		return
+	}
+	for _, x := range args {
+		c.compile(x, false)
+	}
+	for i := len(t.locals) - 1; i >= 0; i -= 1 {
+		c.emit_local(OP_INIT_LOCAL, 0, t.locals[i])
+		c.emit_local(OP_SET_LOCAL, -1, t.locals[i])
+	}
+	// in place of a result, as the code after a tail form expects one
+	c.emit(OP_JUMP, 1, t.start)
+}
+
+func (c *compiler) compile_try(a1 MalType, clauses []MalType, tail bool) {
+	catch_clauses, finally_ast, e := parse_try(clauses)
+	if e != nil {
+		c.fail(e)
+		return
+	}
+	depth := c.depth
+	tail = tail && finally_ast == nil
+	// errors raised by the body go to the catch* clauses, those raised
+	// by the body or the clauses to the finally*; the VM pushes the
+	// exception in place of the result
+	h := handler{start: len(c.p.code), depth: depth}
+	fh := handler{start: len(c.p.code), depth: depth}
+	c.compile(a1, false)
+	h.end = len(c.p.code)
+	jumps := []int{c.emit(OP_JUMP, 0, 0)}
+	h.target = len(c.p.code)
+	for _, cl := range catch_clauses {
+		next := -1
+		if cl.tag != nil {
+			c.p.consts = append(c.p.consts, cl.tag)
+			c.emit(OP_CATCHES, 1, len(c.p.consts)-1)
+			next = c.emit(OP_JUMP_IF_FALSE, -1, 0)
+		}
+		n := len(c.locals)
+		l := c.declare(cl.sym, true)
+		c.emit(OP_CAUGHT, 0)
+		c.emit_local(OP_INIT_LOCAL, 0, l)
+		c.emit_local(OP_SET_LOCAL, -1, l)
+		c.compile(cl.handler, tail)
+		c.locals = c.locals[:n]
+		jumps = append(jumps, c.emit(OP_JUMP, 0, 0))
+		if next >= 0 {
+			c.patch(next, len(c.p.code))
+		}
+		c.depth = depth + 1
+	}
+	// no clause took the exception
+	c.emit(OP_RETHROW, -1)
+	fh.end = len(c.p.code)
+	for _, j := range jumps {
+		c.patch(j, len(c.p.code))
+	}
+	c.depth = depth + 1
+	if len(catch_clauses) > 0 {
+		c.p.handlers = append(c.p.handlers, h)
+	}
+	if finally_ast == nil {
+		return
+	}
+	c.compile(finally_ast, false)
+	c.emit(OP_POP, -1)
+	jump_end := c.emit(OP_JUMP, 0, 0)
+	fh.target = len(c.p.code)
+	c.compile(finally_ast, false)
+	c.emit(OP_POP, -1)
+	c.emit(OP_RETHROW, -1)
+	c.patch(jump_end, len(c.p.code))
+	c.depth = depth + 1
+	c.p.handlers = append(c.p.handlers, fh)
+}
+
+// compile_init compiles the value given to sym by def!, defmacro! or
+// let*. A fn* form there makes a function named after sym, whose body
+// binds &form and &env too when it is a macro.
+func (c *compiler) compile_init(ast MalType, sym Symbol, macro bool) {
+	if lst, ok := ast.(List); ok && starts_with(lst.Slice(), "fn*") {
+		c.compile_fn(lst.Slice()[1:], sym.Val, macro)
+		return
+	}
+	c.compile(ast, false)
+}
+
+// compile_fn pushes a closure for each arity of a fn* (see parse_fn),
+// which OP_ARITIES makes into a single function when there are several
+func (c *compiler) compile_fn(forms []MalType, name string, macro bool) {
+	arities, multi, e := parse_fn(forms, macro)
+	if e != nil {
+		c.fail(e)
+		return
+	}
+	var params, body MalType = nil, nil
+	if !multi {
+		params = forms[0]
+		if len(forms) > 1 {
+			body = forms[1]
+		}
+	}
+	for _, a := range arities {
+		c.compile_arity(a, name, params, body)
+	}
+	if multi {
+		c.p.consts = append(c.p.consts, List{Val: forms})
+		c.emit(OP_ARITIES, 1-len(arities), len(c.p.consts)-1)
+	}
+}
+
+func (c *compiler) compile_arity(a fn_arity, name string, params MalType, body MalType) {
+	fc := &compiler{p: &proto{name: name, params: params, body: body, globals: c.p.globals}, parent: c, pos: c.pos}
+	for _, sym := range a.params {
+		fc.emit_local(OP_INIT_PARAM, 0, fc.declare(sym, true))
+	}
+	fc.p.nparams, fc.p.variadic = a.nparams, a.variadic
+	fc.loop = &vm_loop{len(fc.p.code), append([]*local{}, fc.locals...), 0, true}
+	fc.compile(a.body, true)
+	fc.emit(OP_RETURN, -1)
+	if fc.err != nil && c.err == nil {
+		c.err = fc.err
+	}
+	c.p.protos = append(c.p.protos, fc.p)
+	c.emit(OP_CLOSURE, 1, len(c.p.protos)-1)
+}
+
+// compile_call expands macros as it compiles, like compile.go: the
+// expansion is kept for as long as the Var holds that macro, and once
+// it is redefined, the call is compiled again. A call that turns out to
+// be to a macro when run is expanded then.
+func (c *compiler) compile_call(form List, tail bool) {
+	lst := form.Slice()
+	s := &vm_site{form: form, tail: tail, state: c.snapshot()}
+	if sym, ok := lst[0].(Symbol); ok && !c.is_local(sym) {
+		s.v = global_var(c.p.globals, sym)
+		val, e := s.v.Get()
+		if mac, ok := val.(*MalFunc); e == nil && ok && mac.GetMacro() {
+			new_ast, e := expand_macro(mac, form, c.local_ids())
+			if e != nil {
+				c.fail(e)
+				return
+			}
+			s.macro = mac
+			c.p.sites = append(c.p.sites, s)
+			c.emit(OP_EXPANDED, 0, len(c.p.sites)-1)
+			c.compile(new_ast, tail)
+			s.next = len(c.p.code)
+			return
+		}
+	}
+	c.p.sites = append(c.p.sites, s)
+	outer := c.call
+	c.in_call(form, c.pos)
+	if s.v != nil {
+		c.emit(OP_GET_CALLEE, 1, len(c.p.sites)-1)
+	} else {
+		c.compile(lst[0], false)
+		c.emit(OP_CHECK_CALLEE, 0, len(c.p.sites)-1)
+	}
+	for _, x := range lst[1:] {
+		c.compile(x, false)
+	}
+	n := len(lst) - 1
+	if tail && c.tail_calls() {
+		c.emit(OP_TAIL_CALL, -n, n)
+	} else {
+		c.emit(OP_CALL, -n, n)
+	}
+	s.next = len(c.p.code)
+	c.in_call(outer.form, outer.pos)
+}
+
+// vm_site is a call whose code may have to be compiled again when it
+// is run. That code is added at the end of the proto, compiled from
+// the state the compiler had at the call, and jumps back after it.
+type vm_site struct {
+	form  List
+	v     *Var    // the global called, if any
+	macro MalType // for OP_EXPANDED, the macro the code is expanded by
+	tail  bool
+	next  int // where the code continues after the call
+	state *snapshot
+	// the code last compiled, and the macro it was expanded by
+	cached_for *MalFunc
+	cached_ip  int
+}
+
+// snapshot is the state of a compiler at some point of its code
+type snapshot struct {
+	p       *proto
+	locals  []*local
+	visible []bool
+	depth   int
+	pos     *Pos
+	call    call_span
+	loop    *vm_loop
+	parent  *snapshot
+}
+
+func (c *compiler) snapshot() *snapshot {
+	s := &snapshot{c.p, append([]*local{}, c.locals...), make([]bool, len(c.locals)), c.depth, c.pos, c.call, c.loop, nil}
+	for i, l := range c.locals {
+		s.visible[i] = l.visible
+	}
+	if c.parent != nil {
+		// the parent is still where it compiles the fn* of c
+		if c.outer == nil {
+			c.outer = c.parent.snapshot()
+		}
+		s.parent = c.outer
+	}
+	return s
+}
+
+// resume makes a compiler adding to the proto of s, in the state of s.
+// Its locals were compiled before: those not in cells can no longer be
+// captured, so its closures get a copy of their values, which is the
+// same as long as they are not set again. No upvalue can be added to
+// the closures of s.p either.
+func (s *snapshot) resume() *compiler {
+	c := &compiler{p: s.p, depth: s.depth, pos: s.pos, call: s.call, fixed: true}
+	copies := map[*local]*local{}
+	for i, l := range s.locals {
+		copies[l] = &local{id: l.id, slot: l.slot, visible: s.visible[i], captured: l.captured, fixed: true}
+		c.locals = append(c.locals, copies[l])
+	}
+	if s.loop != nil {
+		loop := *s.loop
+		loop.locals = make([]*local, len(s.loop.locals))
+		for i, l := range s.loop.locals {
+			loop.locals[i] = copies[l]
+		}
+		c.loop = &loop
+	}
+	if s.parent != nil {
+		c.parent = s.parent.resume()
+	}
+	return c
+}
+
+// compile adds the code for the site, run from ip, and gives where it
+// starts. That is the expansion of the call by mac, the macro it turns
+// out to be to, or with mac nil, the whole call again, which then
+// handles any later change itself. The code is kept for the same mac.
+func (s *vm_site) compile(mac *MalFunc, ip int) (int, error) {
+	if s.cached_ip > 0 && s.cached_for == mac {
+		return s.cached_ip, nil
+	}
+	c := s.state.resume()
+	var new_ast MalType = s.form
+	if mac != nil {
+		var e error
+		if new_ast, e = expand_macro(mac, s.form, c.local_ids()); e != nil {
+			return 0, e
+		}
+	}
+	p := c.p
+	handlers := p.handlers
+	start := len(p.code)
+	c.in_call(c.call.form, c.call.pos)
+	c.compile(new_ast, s.tail)
+	c.emit(OP_JUMP, 0, s.next)
+	if c.err != nil {
+		return 0, c.err
+	}
+	// the handlers of the try* forms around the call cover the new code
+	// too, after those of its own
+	for _, h := range handlers {
+		if h.start < ip && ip <= h.end {
+			p.handlers = append(p.handlers, handler{start, len(p.code), h.target, h.depth})
+		}
+	}
+	s.cached_for, s.cached_ip = mac, start
+	return start, nil
+}
@@ -0,0 +1,980 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+import (
+	. "mal/src/env"
+	. "mal/src/types"
+)
+
+// Forms are evaluated in two passes. compile analyses a form once,
+// resolving special forms, macros and local variables, and produces a
+// tree of Go closures. Running that tree then only does the work that
+// depends on runtime values.
+
+// code is a compiled form. A call made in tail position is not
+// performed; a *tailCall is returned instead for run to continue with,
+// so that the Go stack does not grow.
+type code func(f *frame) (MalType, error)
+
+// lambda is a compiled fn* body, or a compiled top-level form. Every
+// local the body binds (parameters, let* and catch* bindings) gets its
+// own slot in the frame, and code addresses it by (depth, index).
+type lambda struct {
+	name     string // for stack traces
+	body     code
+	ids      []uint32 // the symbol Id of each slot
+	nparams  int
+	variadic bool
+	globals  *Env
+	bind     func(EnvType, MalType, MalType) (EnvType, error)
+	target   *loop_target // for a recur in the body
+	err      error        // found while compiling, see reject
+}
+
+// frame is the Env frame of one activation of a lambda. It is also the
+// environment of the MalFunc values created inside it.
+type frame struct {
+	Env
+	lam *lambda
+}
+
+func new_frame(lam *lambda, outer *Env, slots []MalType) *frame {
+	f := &frame{lam: lam}
+	f.Env = *NewFrame(outer, lam.ids, slots)
+	return f
+}
+
+// new_env is the GenEnv of the functions compiled from lam
+func (lam *lambda) new_env(outer EnvType, _ MalType, args_mt MalType) (EnvType, error) {
+	args, e := GetSlice(args_mt)
+	if e != nil {
+		return nil, e
+	}
+	if len(args) < lam.nparams || !lam.variadic && len(args) > lam.nparams {
+		return nil, arity_error(len(args), lam.name)
+	}
+	slots := make([]MalType, len(lam.ids))
+	copy(slots, args[:lam.nparams])
+	if lam.variadic {
+		slots[lam.nparams] = List{Val: args[lam.nparams:]}
+	}
+	return new_frame(lam, &outer.(*frame).Env, slots), nil
+}
+
+// eval_frame is the Eval of compiled functions: the frame made by
+// new_env already knows the code to run
+func eval_frame(_ MalType, env EnvType) (MalType, error) {
+	return run(env.(*frame))
+}
+
+type tailCall struct {
+	f *frame
+}
+
+func (tc *tailCall) Type() string           { return "tail call" }
+func (tc *tailCall) Equal(obj MalType) bool { return false }
+func (tc *tailCall) Hash() uint32           { return 0 }
+func (tc *tailCall) String() string         { return "#<tail call>" }
+
+// recurCall is what a recur returns, for the enclosing loop* or
+// function to run its body again with args
+type recurCall struct {
+	args []MalType
+}
+
+func (rc *recurCall) Type() string           { return "recur" }
+func (rc *recurCall) Equal(obj MalType) bool { return false }
+func (rc *recurCall) Hash() uint32           { return 0 }
+func (rc *recurCall) String() string         { return "#<recur>" }
+
+func run(f *frame) (MalType, error) {
+	for {
+		res, e := f.lam.body(f)
+		switch r := res.(type) {
+		case *tailCall:
+			f = r.f
+		case *recurCall:
+			f = f.lam.target.rebind(f, r.args)
+		default:
+			return res, e
+		}
+	}
+}
+
+// loop_target is a loop* or function body, which a recur in tail
+// position runs again with new values in slots
+type loop_target struct {
+	slots []int
+	// whether the loop* is in tail position of its function, so that
+	// calls in tail position of the body are tail calls
+	tail bool
+	// whether functions are made in the body. They keep the frame, so
+	// each pass then gets a copy of it instead of changing its values.
+	captured bool
+	outer    *loop_target // in the same function
+}
+
+// rebind sets the slots of the target for the next pass of its body
+func (t *loop_target) rebind(f *frame, args []MalType) *frame {
+	if t.captured {
+		f = &frame{*f.Env.Copy(), f.lam}
+	}
+	for i, arg := range args {
+		f.SetAt(t.slots[i], arg)
+	}
+	return f
+}
+
+// scope tracks the locals visible while compiling the body of a
+// lambda; outer is the scope of the enclosing lambda
+type scope struct {
+	lam   *lambda
+	ids   []uint32
+	slots []int
+	outer *scope
+	pos   *Pos         // of the innermost list read with a position
+	loop  *loop_target // the innermost loop* or fn*, nil at top level
+	// the bindings of the let* forms being compiled. Like in a single
+	// let* environment, functions created while evaluating a binding
+	// already see all of them.
+	pending []binding
+}
+
+type binding struct {
+	id   uint32
+	slot int
+}
+
+// new_slot allocates a slot in the frame without making it visible
+func (sc *scope) new_slot(sym Symbol) int {
+	sc.lam.ids = append(sc.lam.ids, sym.Id)
+	return len(sc.lam.ids) - 1
+}
+
+func (sc *scope) declare(sym Symbol) int {
+	idx := sc.new_slot(sym)
+	sc.ids = append(sc.ids, sym.Id)
+	sc.slots = append(sc.slots, idx)
+	return idx
+}
+
+// restore drops the locals declared since len(sc.ids) was n
+func (sc *scope) restore(n int) {
+	sc.ids, sc.slots = sc.ids[:n], sc.slots[:n]
+}
+
+// lookup finds a local, giving the number of frames out from the
+// current one and its slot there
+func (sc *scope) lookup(sym Symbol) (int, int, bool) {
+	for depth := 0; sc != nil; depth, sc = depth+1, sc.outer {
+		for i := len(sc.pending) - 1; depth > 0 && i >= 0; i -= 1 {
+			if sc.pending[i].id == sym.Id {
+				return depth, sc.pending[i].slot, true
+			}
+		}
+		for i := len(sc.ids) - 1; i >= 0; i -= 1 {
+			if sc.ids[i] == sym.Id {
+				return depth, sc.slots[i], true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// local_ids gives the Ids of the symbols lookup finds
+func (sc *scope) local_ids() map[uint32]bool {
+	ids := map[uint32]bool{}
+	for depth := 0; sc != nil; depth, sc = depth+1, sc.outer {
+		for _, b := range sc.pending {
+			if depth > 0 {
+				ids[b.id] = true
+			}
+		}
+		for _, id := range sc.ids {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+// snapshot copies the locals visible now, for compiling code later
+func (sc *scope) snapshot() *scope {
+	return &scope{sc.lam, append([]uint32{}, sc.ids...), append([]int{}, sc.slots...), sc.outer, sc.pos, sc.loop, append([]binding{}, sc.pending...)}
+}
+
+// tail_calls tells whether a call in tail position, which may only be
+// in tail position of a loop*, is in tail position of the function
+func (sc *scope) tail_calls() bool {
+	return sc.loop == nil || sc.loop.tail
+}
+
+func constant(obj MalType) code {
+	return func(*frame) (MalType, error) { return obj, nil }
+}
+
+// fail defers an error found while compiling until the form is run,
+// so that it can be caught by an enclosing try*
+func fail(e error) code {
+	return func(*frame) (MalType, error) { return nil, e }
+}
+
+// reject is fail for errors that keep the whole top-level form from
+// being run
+func reject(e error, sc *scope) code {
+	if sc.lam.err == nil {
+		sc.lam.err = e
+	}
+	return fail(e)
+}
+
+func compile_all(xs []MalType, sc *scope) []code {
+	codes := make([]code, len(xs))
+	for i, x := range xs {
+		codes[i] = compile(x, sc, false)
+	}
+	return codes
+}
+
+func run_all(codes []code, f *frame) ([]MalType, error) {
+	lst := make([]MalType, len(codes))
+	for i, c := range codes {
+		exp, e := c(f)
+		if e != nil {
+			return nil, e
+		}
+		lst[i] = exp
+	}
+	return lst, nil
+}
+
+func compile(ast MalType, sc *scope, tail bool) code {
+	switch a := ast.(type) {
+	case Symbol:
+		return compile_symbol(a, sc)
+	case Vector:
+		codes := compile_all(a.Val, sc)
+		return func(f *frame) (MalType, error) {
+			lst, e := run_all(codes, f)
+			if e != nil {
+				return nil, e
+			}
+			return Vector{lst, nil}, nil
+		}
+	case HashMap:
+		// the keys are evaluated too, as in {k 1} or {'s 1}
+		forms := make([]MalType, 0, 2*a.Count())
+		for _, entry := range a.Entries() {
+			forms = append(forms, entry.Key, entry.Value)
+		}
+		codes := compile_all(forms, sc)
+		return func(f *frame) (MalType, error) {
+			kvs, e := run_all(codes, f)
+			if e != nil {
+				return nil, e
+			}
+			return HashMap{}.AssocAll(kvs...), nil
+		}
+	case List:
+		if a.Count() == 0 {
+			return constant(ast)
+		}
+		if a.Pos != nil {
+			defer func(pos *Pos) { sc.pos = pos }(sc.pos)
+			sc.pos = a.Pos
+		}
+		return compile_list(a, sc, tail)
+	default:
+		return constant(ast)
+	}
+}
+
+func compile_symbol(sym Symbol, sc *scope) code {
+	if depth, idx, ok := sc.lookup(sym); ok {
+		return func(f *frame) (MalType, error) { return f.At(depth, idx), nil }
+	}
+	v := global_var(sc.lam.globals, sym)
+	return func(*frame) (MalType, error) { return v.Get() }
+}
+
+// def_name gives the symbol a def! or defmacro! defines. A name read
+// with metadata, such as ^:private name, comes as (with-meta name meta).
+func def_name(form MalType) (Symbol, bool) {
+	if lst, ok := form.(List); ok && lst.Count() == 3 && starts_with(lst.Slice(), "with-meta") {
+		form = lst.Slice()[1]
+	}
+	sym, ok := form.(Symbol)
+	return sym, ok
+}
+
+func compile_list(form List, sc *scope, tail bool) code {
+	lst := form.Slice()
+	var a1 MalType = nil
+	var a2 MalType = nil
+	switch len(lst) {
+	case 1:
+	case 2:
+		a1 = lst[1]
+	default:
+		a1 = lst[1]
+		a2 = lst[2]
+	}
+	a0sym := "__<*fn*>__"
+	if Symbol_Q(lst[0]) {
+		a0sym = lst[0].(Symbol).Val
+	}
+	switch a0sym {
+	case "def!", "defmacro!":
+		sym, ok := def_name(a1)
+		if !ok {
+			return fail(NewError("syntax", a0sym+" requires a symbol"))
+		}
+		// the Var is made first, so that a function can call itself
+		v, e := define_var(sc.lam.globals, sym)
+		if e != nil {
+			return fail(e)
+		}
+		macro := a0sym == "defmacro!"
+		val := compile_init(a2, sym, macro, sc)
+		// definitions are always global, even inside fn* or let*
+		return func(f *frame) (MalType, error) {
+			res, e := val(f)
+			if e != nil {
+				return nil, e
+			}
+			if macro {
+				fn, ok := res.(*MalFunc)
+				if !ok {
+					return nil, errors.New("defmacro! requires a function")
+				}
+				res = fn.SetMacro()
+			}
+			v.Set(res)
+			return res, nil
+		}
+	case "let*":
+		return compile_let(a1, a2, sc, tail)
+	case "loop*":
+		return compile_loop(a1, a2, sc, tail)
+	case "recur":
+		return compile_recur(lst[1:], sc, tail)
+	case "quote":
+		return constant(a1)
+	case "quasiquote":
+		return compile(quasiquote(a1, sc.lam.globals), sc, tail)
+	case "try*":
+		return compile_try(a1, lst[min(2, len(lst)):], sc, tail)
+	case "do":
+		if len(lst) == 1 {
+			return constant(nil)
+		}
+		codes := compile_all(lst[1:len(lst)-1], sc)
+		last := compile(lst[len(lst)-1], sc, tail)
+		return func(f *frame) (MalType, error) {
+			for _, c := range codes {
+				if _, e := c(f); e != nil {
+					return nil, e
+				}
+			}
+			return last(f)
+		}
+	case "if":
+		cond := compile(a1, sc, false)
+		then := compile(a2, sc, tail)
+		var els code = constant(nil)
+		if len(lst) >= 4 {
+			els = compile(lst[3], sc, tail)
+		}
+		return func(f *frame) (MalType, error) {
+			c, e := cond(f)
+			if e != nil {
+				return nil, e
+			}
+			if c == nil || c == Bool(false) {
+				return els(f)
+			}
+			return then(f)
+		}
+	case "fn*":
+		return compile_fn(lst[1:], "fn*", false, sc)
+	case "macroexpand-1", "macroexpand", "macroexpand-all":
+		x := &expander{sc.lam.globals, sc.local_ids()}
+		return func(*frame) (MalType, error) { return x.macroexpand(a0sym, a1) }
+	default:
+		return compile_call(form, sc, tail)
+	}
+}
+
+// compile_bindings compiles the bindings of a let* or loop*, leaving
+// their symbols declared. It gives the code of the values and their
+// slots.
+func compile_bindings(a1 MalType, sc *scope) ([]code, []int, error) {
+	binds, e := GetSlice(a1)
+	if e != nil {
+		return nil, nil, e
+	}
+	if binds, e = destructure(binds); e != nil {
+		return nil, nil, e
+	}
+	p := len(sc.pending)
+	defer func() { sc.pending = sc.pending[:p] }()
+	slots := []int{}
+	for i := 0; i < len(binds); i += 2 {
+		sym, ok := binds[i].(Symbol)
+		if !ok {
+			return nil, nil, NewError("syntax", "non-symbol bind value")
+		}
+		slots = append(slots, sc.new_slot(sym))
+		sc.pending = append(sc.pending, binding{sym.Id, slots[len(slots)-1]})
+	}
+	codes := []code{}
+	for i := 0; i < len(binds); i += 2 {
+		var init MalType = nil
+		if i+1 < len(binds) {
+			init = binds[i+1]
+		}
+		codes = append(codes, compile_init(init, binds[i].(Symbol), false, sc))
+		sc.ids = append(sc.ids, binds[i].(Symbol).Id)
+		sc.slots = append(sc.slots, slots[i/2])
+	}
+	return codes, slots, nil
+}
+
+func init_bindings(codes []code, slots []int, f *frame) error {
+	for i, c := range codes {
+		exp, e := c(f)
+		if e != nil {
+			return e
+		}
+		f.SetAt(slots[i], exp)
+	}
+	return nil
+}
+
+func compile_let(a1 MalType, a2 MalType, sc *scope, tail bool) code {
+	defer sc.restore(len(sc.ids))
+	codes, slots, e := compile_bindings(a1, sc)
+	if e != nil {
+		return fail(e)
+	}
+	body := compile(a2, sc, tail)
+	return func(f *frame) (MalType, error) {
+		if e := init_bindings(codes, slots, f); e != nil {
+			return nil, e
+		}
+		return body(f)
+	}
+}
+
+// compile_loop compiles a loop*: a let* whose body a recur runs again,
+// in the same frame
+func compile_loop(a1 MalType, a2 MalType, sc *scope, tail bool) code {
+	if binds, e := GetSlice(a1); e == nil {
+		if form, ok := destructure_loop(binds, a2); ok {
+			return compile(form, sc, tail)
+		}
+	}
+	defer sc.restore(len(sc.ids))
+	codes, slots, e := compile_bindings(a1, sc)
+	if e != nil {
+		return fail(e)
+	}
+	target := &loop_target{slots: slots, tail: tail && sc.tail_calls(), outer: sc.loop}
+	defer func(outer *loop_target) { sc.loop = outer }(sc.loop)
+	sc.loop = target
+	body := compile(a2, sc, true)
+	return func(f *frame) (MalType, error) {
+		if e := init_bindings(codes, slots, f); e != nil {
+			return nil, e
+		}
+		for {
+			res, e := body(f)
+			rc, ok := res.(*recurCall)
+			if !ok {
+				return res, e
+			}
+			f = target.rebind(f, rc.args)
+		}
+	}
+}
+
+func compile_recur(args []MalType, sc *scope, tail bool) code {
+	if sc.loop == nil {
+		return reject(NewError("syntax", "recur outside of loop* or fn*"), sc)
+	}
+	if !tail {
+		return reject(NewError("syntax", "recur must be in tail position"), sc)
+	}
+	if len(args) != len(sc.loop.slots) {
+		return reject(NewError("arity", fmt.Sprintf("recur: wrong number of arguments (%d instead of %d)", len(args), len(sc.loop.slots))), sc)
+	}
+	codes := compile_all(args, sc)
+	return func(f *frame) (MalType, error) {
+		vals, e := run_all(codes, f)
+		if e != nil {
+			return nil, e
+		}
+		return &recurCall{vals}, nil
+	}
+}
+
+// catch_clause is a (catch* sym handler) clause of a try*, or a
+// (catch* tag sym handler) one only taking the exceptions tag matches
+type catch_clause struct {
+	tag     MalType // nil to catch anything
+	sym     Symbol
+	handler MalType
+}
+
+// parse_try splits the clauses following the body of a try* into its
+// catch* clauses and a do form running the body of its finally*, nil
+// if there is none
+func parse_try(clauses []MalType) ([]catch_clause, MalType, error) {
+	catches := []catch_clause{}
+	var finally MalType = nil
+	for i, clause := range clauses {
+		lst, ok := clause.(List)
+		switch {
+		case ok && starts_with(lst.Slice(), "finally*"):
+			if i != len(clauses)-1 {
+				return nil, nil, NewError("syntax", "finally* must be the last clause of try*")
+			}
+			finally = List{Val: append([]MalType{NewSymbol("do")}, lst.Slice()[1:]...)}
+		case ok && starts_with(lst.Slice(), "catch*"):
+			c := catch_clause{}
+			args := lst.Slice()[1:]
+			if len(args) > 2 {
+				c.tag, args = args[0], args[1:]
+				if !Symbol_Q(c.tag) && !Keyword_Q(c.tag) {
+					return nil, nil, NewError("syntax", "catch* type must be a symbol or keyword")
+				}
+			}
+			if len(args) == 0 || !Symbol_Q(args[0]) {
+				return nil, nil, NewError("syntax", "catch* requires a symbol")
+			}
+			c.sym = args[0].(Symbol)
+			if len(args) > 1 {
+				c.handler = args[1]
+			}
+			catches = append(catches, c)
+		default:
+			return nil, nil, NewError("syntax", "try* clauses must be catch* or finally* forms")
+		}
+	}
+	return catches, finally, nil
+}
+
+// catches tells whether a catch* clause with tag takes exc. A keyword
+// is matched against the :type of an ex-info or thrown map, a symbol
+// against the type of exc.
+func catches(tag MalType, exc MalType) bool {
+	switch tag := tag.(type) {
+	case nil:
+		return true
+	case Keyword:
+		var data MalType = exc
+		if ex, ok := exc.(*ExInfo); ok {
+			data = ex.Data
+		}
+		if m, ok := data.(HashMap); ok {
+			typ, found := m.ValAt(Keyword("type"))
+			return found && typ == MalType(tag)
+		}
+		return false
+	default:
+		return TypeOf(exc) == tag.(Symbol).Val
+	}
+}
+
+func compile_try(a1 MalType, clauses []MalType, sc *scope, tail bool) code {
+	body := compile(a1, sc, false)
+	catch_clauses, finally_ast, e := parse_try(clauses)
+	if e != nil {
+		return fail(e)
+	}
+	// with a finally* to run, a handler's tail call would escape it
+	tail = tail && finally_ast == nil
+	slots := make([]int, len(catch_clauses))
+	handlers := make([]code, len(catch_clauses))
+	for i, c := range catch_clauses {
+		n := len(sc.ids)
+		slots[i] = sc.declare(c.sym)
+		handlers[i] = compile(c.handler, sc, tail)
+		sc.restore(n)
+	}
+	var finally code
+	if finally_ast != nil {
+		finally = compile(finally_ast, sc, false)
+	}
+	return func(f *frame) (MalType, error) {
+		exp, e := body(f)
+		if e != nil {
+			exc := exception(e)
+			for i, c := range catch_clauses {
+				if catches(c.tag, exc) {
+					f.SetAt(slots[i], exc)
+					exp, e = handlers[i](f)
+					break
+				}
+			}
+		}
+		if finally != nil {
+			if _, fe := finally(f); fe != nil {
+				return nil, fe
+			}
+		}
+		return exp, e
+	}
+}
+
+// exception gives the value catch* binds for an error: what was thrown,
+// or an ex-info for an internal error
+func exception(e error) MalType {
+	switch e := Untraced(e).(type) {
+	case MalError:
+		return e.Obj
+	default:
+		return ErrorInfo("error", e.Error())
+	}
+}
+
+// compile_init compiles the value given to sym by def!, defmacro! or
+// let*. A fn* form there makes a function named after sym, whose body
+// binds &form and &env too when it is a macro.
+func compile_init(ast MalType, sym Symbol, macro bool, sc *scope) code {
+	if lst, ok := ast.(List); ok && starts_with(lst.Slice(), "fn*") {
+		return compile_fn(lst.Slice()[1:], sym.Val, macro, sc)
+	}
+	return compile(ast, sc, false)
+}
+
+// fn_arity is one arity of a fn*, its parameters destructured into
+// symbols
+type fn_arity struct {
+	params   []Symbol // including the rest parameter
+	nparams  int
+	variadic bool
+	body     MalType
+}
+
+// parse_fn gives the arities of a fn* from the forms after fn*: the
+// parameters and body, or a (params body...) list for each arity, in
+// which case multi is set. The bodies of a macro are made to bind
+// &form and &env, see macro_body.
+func parse_fn(forms []MalType, macro bool) (arities []fn_arity, multi bool, err error) {
+	wrap := func(body MalType) MalType { return body }
+	if macro {
+		wrap = macro_body
+	}
+	if !fn_multi(forms) {
+		var params, body MalType = nil, nil
+		if len(forms) > 0 {
+			params = forms[0]
+		}
+		if len(forms) > 1 {
+			body = forms[1]
+		}
+		a, e := parse_arity(params, wrap(body))
+		return []fn_arity{a}, false, e
+	}
+	for _, form := range forms {
+		clause := form.(List).Slice()
+		var body MalType = nil
+		switch len(clause) {
+		case 1:
+		case 2:
+			body = clause[1]
+		default:
+			body = List{Val: append([]MalType{NewSymbol("do")}, clause[1:]...)}
+		}
+		a, e := parse_arity(clause[0], wrap(body))
+		if e != nil {
+			return nil, true, e
+		}
+		arities = append(arities, a)
+	}
+	return arities, true, check_arities(arities)
+}
+
+// fn_multi tells whether the forms after fn* are a list for each arity
+func fn_multi(forms []MalType) bool {
+	for _, form := range forms {
+		if lst, ok := form.(List); !ok || lst.Count() == 0 || !Vector_Q(lst.Slice()[0]) {
+			return false
+		}
+	}
+	return len(forms) > 0
+}
+
+func parse_arity(params MalType, body MalType) (fn_arity, error) {
+	a := fn_arity{}
+	binds, e := GetSlice(params)
+	if e != nil {
+		return a, e
+	}
+	binds, a.body = destructure_params(binds, body)
+	for i := 0; i < len(binds); i += 1 {
+		sym, ok := binds[i].(Symbol)
+		if !ok {
+			return a, NewError("syntax", "fn* parameters must be symbols")
+		}
+		if sym.Val == "&" {
+			if i+2 != len(binds) || !Symbol_Q(binds[i+1]) {
+				return a, NewError("syntax", "fn* requires one symbol after &")
+			}
+			a.params = append(a.params, binds[i+1].(Symbol))
+			a.variadic = true
+			break
+		}
+		a.params = append(a.params, sym)
+		a.nparams += 1
+	}
+	return a, nil
+}
+
+// check_arities rejects a fn* where more than one arity could take the
+// same number of arguments
+func check_arities(arities []fn_arity) error {
+	variadic := -1
+	for i, a := range arities {
+		if !a.variadic {
+			continue
+		}
+		if variadic >= 0 {
+			return NewError("syntax", "fn* can only have one variadic arity")
+		}
+		variadic = i
+	}
+	for i, a := range arities {
+		if a.variadic {
+			continue
+		}
+		if variadic >= 0 && a.nparams > arities[variadic].nparams {
+			return NewError("syntax", "fn* can't have a fixed arity with more parameters than the variadic one")
+		}
+		for _, b := range arities[i+1:] {
+			if !b.variadic && b.nparams == a.nparams {
+				return NewError("syntax", "fn* can't have two arities with the same number of parameters")
+			}
+		}
+	}
+	return nil
+}
+
+// pick_arity gives the index of the arity a call with n arguments
+// runs, or -1 if there is none
+func pick_arity(arities []fn_arity, n int) int {
+	variadic := -1
+	for i, a := range arities {
+		if a.variadic {
+			variadic = i
+		} else if a.nparams == n {
+			return i
+		}
+	}
+	if variadic >= 0 && n >= arities[variadic].nparams {
+		return variadic
+	}
+	return -1
+}
+
+func arity_error(n int, name string) error {
+	return NewError("arity", fmt.Sprintf("wrong number of args (%d) passed to %s", n, name))
+}
+
+func compile_fn(forms []MalType, name string, macro bool, sc *scope) code {
+	arities, multi, e := parse_fn(forms, macro)
+	if e != nil {
+		return fail(e)
+	}
+	// the frames of enclosing loops are kept by the function
+	for t := sc.loop; t != nil; t = t.outer {
+		t.captured = true
+	}
+	lams := make([]*lambda, len(arities))
+	for i, a := range arities {
+		lams[i] = compile_arity(a, name, sc)
+	}
+	if !multi {
+		lam, params := lams[0], forms[0]
+		var body MalType = nil
+		if len(forms) > 1 {
+			body = forms[1]
+		}
+		return func(f *frame) (MalType, error) {
+			return &MalFunc{eval_frame, body, f, params, false, lam.bind, nil}, nil
+		}
+	}
+	// the frame for the arity called is made by its lambda
+	bind := func(outer EnvType, params MalType, args_mt MalType) (EnvType, error) {
+		args, e := GetSlice(args_mt)
+		if e != nil {
+			return nil, e
+		}
+		i := pick_arity(arities, len(args))
+		if i < 0 {
+			return nil, arity_error(len(args), name)
+		}
+		return lams[i].new_env(outer, params, args_mt)
+	}
+	clauses := List{Val: forms}
+	return func(f *frame) (MalType, error) {
+		return &MalFunc{eval_frame, clauses, f, nil, false, bind, nil}, nil
+	}
+}
+
+func compile_arity(a fn_arity, name string, sc *scope) *lambda {
+	lam := &lambda{name: name, globals: sc.lam.globals, nparams: a.nparams, variadic: a.variadic}
+	lam.bind = lam.new_env
+	lam.target = &loop_target{tail: true}
+	inner := &scope{lam: lam, outer: sc, pos: sc.pos, loop: lam.target}
+	for _, sym := range a.params {
+		lam.target.slots = append(lam.target.slots, inner.declare(sym))
+	}
+	lam.body = compile(a.body, inner, true)
+	if lam.err != nil && sc.lam.err == nil {
+		sc.lam.err = lam.err
+	}
+	return lam
+}
+
+// global_macro returns the macro a symbol names, when it is not
+// shadowed by a local
+func global_macro(sym Symbol, sc *scope) *MalFunc {
+	if _, _, ok := sc.lookup(sym); ok {
+		return nil
+	}
+	val, e := global_var(sc.lam.globals, sym).Get()
+	if fn, ok := val.(*MalFunc); e == nil && ok && fn.GetMacro() {
+		return fn
+	}
+	return nil
+}
+
+func compile_call(form List, sc *scope, tail bool) code {
+	lst := form.Slice()
+	// a macro already defined is expanded once, here. The expansion is
+	// kept for as long as the var holds that macro; once it is
+	// redefined, the form is compiled again.
+	if sym, ok := lst[0].(Symbol); ok {
+		if mac := global_macro(sym, sc); mac != nil {
+			if new_ast, e := expand_macro(mac, form, sc.local_ids()); e == nil {
+				v := global_var(sc.lam.globals, sym)
+				var compiled_for MalType = mac
+				expansion := compile(new_ast, sc, tail)
+				snap := sc.snapshot()
+				return func(f *frame) (MalType, error) {
+					if v.Val != compiled_for {
+						compiled_for = v.Val
+						expansion = compile_block(form, snap, tail)
+					}
+					return expansion(f)
+				}
+			}
+		}
+	}
+	fc := compile(lst[0], sc, false)
+	args := compile_all(lst[1:], sc)
+	expand := compile_expansion(form, sc.snapshot(), tail)
+	s := &site{sc.lam.name, List{Val: lst}, sc.pos}
+	tail_call := tail && sc.tail_calls()
+	return func(f *frame) (MalType, error) {
+		fn, e := fc(f)
+		if e != nil {
+			return nil, s.trace(e, false)
+		}
+		if mac, ok := fn.(*MalFunc); ok && mac.GetMacro() {
+			return expand(mac, f)
+		}
+		vals, e := run_all(args, f)
+		if e != nil {
+			return nil, s.trace(e, false)
+		}
+		res, e := call(fn, vals, tail_call)
+		if e != nil {
+			return nil, s.trace(e, true)
+		}
+		return res, nil
+	}
+}
+
+// site is a call in a compiled function, for stack traces. Calls in
+// tail position leave no trace once they have been made, as the frame
+// of the caller is gone.
+type site struct {
+	fn   string
+	form MalType
+	pos  *Pos
+}
+
+// trace adds the site to the stack trace of an error. An error from
+// evaluating the arguments that already has a trace comes from a call
+// nested in this one, which has the entry for this function.
+func (s *site) trace(e error, called bool) error {
+	if _, ok := e.(*TracedError); ok && !called {
+		return e
+	}
+	return AddTrace(e, TraceFrame{s.fn, s.form, s.pos})
+}
+
+// compile_block compiles ast while the enclosing lambda is running, so
+// the code gets its own frame for any locals it binds. sc is a
+// snapshot of the scope ast appears in.
+func compile_block(ast MalType, sc *scope, tail bool) code {
+	lam := &lambda{name: sc.lam.name, globals: sc.lam.globals}
+	lam.body = compile(ast, &scope{lam: lam, outer: sc, pos: sc.pos, loop: sc.loop}, tail)
+	if lam.err != nil {
+		return fail(lam.err)
+	}
+	return func(f *frame) (MalType, error) {
+		return lam.body(new_frame(lam, &f.Env, make([]MalType, len(lam.ids))))
+	}
+}
+
+// compile_expansion handles calls that turn out to be to a macro only
+// when run, such as a macro defined earlier in the same top-level do.
+// The expansion is kept for as long as the same macro is called.
+func compile_expansion(form List, sc *scope, tail bool) func(*MalFunc, *frame) (MalType, error) {
+	var cached_mac *MalFunc = nil
+	var cached code = nil
+	return func(mac *MalFunc, f *frame) (MalType, error) {
+		if mac != cached_mac {
+			new_ast, e := expand_macro(mac, form, sc.local_ids())
+			if e != nil {
+				return nil, e
+			}
+			cached_mac, cached = mac, compile_block(new_ast, sc, tail)
+		}
+		return cached(f)
+	}
+}
+
+func call(fn MalType, args []MalType, tail bool) (MalType, error) {
+	switch f := fn.(type) {
+	case *MalFunc:
+		env, e := f.GenEnv(f.Env, f.Params, List{Val: args})
+		if e != nil {
+			return nil, e
+		}
+		if fr, ok := env.(*frame); ok && tail {
+			return &tailCall{fr}, nil
+		}
+		return f.Eval(f.Exp, env)
+	case *Func:
+		return call_builtin(f, args)
+	case IFn:
+		return f.Invoke(args)
+	default:
+		return nil, NewError("type", "attempt to call non-function")
+	}
+}
+
+// call_builtin calls a Go function, turning a panic into an error like
+// Apply does, as not all of them check their arguments
+func call_builtin(f *Func, args []MalType) (res MalType, e error) {
+	defer Recover(TypeOf(f), args, &e)
+	return f.Fn(args)
+}
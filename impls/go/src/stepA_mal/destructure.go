@@ -0,0 +1,267 @@
+package main
+
+import (
+	"mal/src/core"
+	"mal/src/printer"
+	. "mal/src/types"
+)
+
+// Destructuring. The binding forms of let*, loop* and fn* that are not
+// symbols are rewritten into bindings of symbols before compiling, so
+// that both compilers only ever bind symbols:
+//
+//	(let* [[a & r :as all] xs] ...)
+//
+// becomes
+//
+//	(let* [vec__1 xs a (nth vec__1 0) r (nthnext vec__1 1) all vec__1] ...)
+//
+// where nth and nthnext are the Go functions below themselves rather
+// than symbols, so that redefining a global does not change what a
+// binding means.
+
+// temp makes a symbol for a value being destructured
+func temp(prefix string) Symbol {
+	return core.Gensym(prefix + "__")
+}
+
+func call_form(f *Func, args ...MalType) MalType {
+	return List{Val: append([]MalType{f}, args...)}
+}
+
+// destructure rewrites the bindings of a let* into bindings of symbols
+func destructure(binds []MalType) ([]MalType, error) {
+	res := []MalType{}
+	for i := 0; i < len(binds); i += 2 {
+		var init MalType = nil
+		if i+1 < len(binds) {
+			init = binds[i+1]
+		}
+		var e error
+		if res, e = bind_form(res, binds[i], init); e != nil {
+			return nil, e
+		}
+	}
+	return res, nil
+}
+
+// destructure_params rewrites the parameters of a fn* into symbols,
+// giving the body a let* binding the original forms to them
+func destructure_params(params []MalType, body MalType) ([]MalType, MalType) {
+	syms := make([]MalType, len(params))
+	binds := []MalType{}
+	for i, param := range params {
+		if Symbol_Q(param) {
+			syms[i] = param
+			continue
+		}
+		syms[i] = temp("p")
+		binds = append(binds, param, syms[i])
+	}
+	if len(binds) == 0 {
+		return params, body
+	}
+	return syms, List{Val: []MalType{NewSymbol("let*"), Vector{Val: binds}, body}}
+}
+
+// destructure_loop rewrites a loop* binding anything but symbols into
+// a let* around a loop* on symbols, whose body binds the original
+// forms again on each pass
+func destructure_loop(binds []MalType, body MalType) (MalType, bool) {
+	outer, loop, inner := []MalType{}, []MalType{}, []MalType{}
+	for i := 0; i < len(binds); i += 2 {
+		var init MalType = nil
+		if i+1 < len(binds) {
+			init = binds[i+1]
+		}
+		if sym, ok := binds[i].(Symbol); ok {
+			outer = append(outer, sym, init)
+			loop = append(loop, sym, sym)
+			continue
+		}
+		t := temp("loop")
+		outer = append(outer, t, init, binds[i], t)
+		loop = append(loop, t, t)
+		inner = append(inner, binds[i], t)
+	}
+	if len(inner) == 0 {
+		return nil, false
+	}
+	return List{Val: []MalType{NewSymbol("let*"), Vector{Val: outer},
+		List{Val: []MalType{NewSymbol("loop*"), Vector{Val: loop},
+			List{Val: []MalType{NewSymbol("let*"), Vector{Val: inner}, body}}}}}}, true
+}
+
+// bind_form appends to res the bindings of form to the value of init
+func bind_form(res []MalType, form MalType, init MalType) ([]MalType, error) {
+	switch f := form.(type) {
+	case Symbol:
+		return append(res, f, init), nil
+	case Vector:
+		return bind_seq(res, f.Val, init)
+	case HashMap:
+		return bind_map(res, f, init)
+	default:
+		return nil, NewError("syntax", "unsupported binding form: "+printer.Pr_str(form, true))
+	}
+}
+
+func bind_seq(res []MalType, forms []MalType, init MalType) ([]MalType, error) {
+	v := temp("vec")
+	res = append(res, v, init)
+	n := 0
+	for i := 0; i < len(forms); i += 1 {
+		var e error
+		switch {
+		case forms[i] == Keyword("as"):
+			if i+1 >= len(forms) || !Symbol_Q(forms[i+1]) {
+				return nil, NewError("syntax", ":as must be followed by a symbol")
+			}
+			res = append(res, forms[i+1], v)
+			i += 1
+		case Symbol_Q(forms[i]) && forms[i].(Symbol).Val == "&":
+			if i+1 >= len(forms) {
+				return nil, NewError("syntax", "& must be followed by a binding form")
+			}
+			if i+2 < len(forms) && forms[i+2] != MalType(Keyword("as")) {
+				return nil, NewError("syntax", "& must be followed by a single binding form")
+			}
+			res, e = bind_form(res, forms[i+1], call_form(nthnext_fn, v, Int(n)))
+			i += 1
+		default:
+			res, e = bind_form(res, forms[i], call_form(nth_fn, v, Int(n)))
+			n += 1
+		}
+		if e != nil {
+			return nil, e
+		}
+	}
+	return res, nil
+}
+
+func bind_map(res []MalType, form HashMap, init MalType) ([]MalType, error) {
+	m := temp("map")
+	res = append(res, m, call_form(map_fn, init))
+	if as, ok := form.ValAt(Keyword("as")); ok {
+		if !Symbol_Q(as) {
+			return nil, NewError("syntax", ":as must be followed by a symbol")
+		}
+		res = append(res, as, m)
+	}
+	defaults := HashMap{}
+	if or, ok := form.ValAt(Keyword("or")); ok {
+		if defaults, ok = or.(HashMap); !ok {
+			return nil, NewError("syntax", ":or must be followed by a map")
+		}
+	}
+	lookup := func(sym MalType, key MalType) MalType {
+		if d, ok := defaults.ValAt(sym); ok {
+			return call_form(get_fn, m, key, d)
+		}
+		return call_form(get_fn, m, key)
+	}
+	for _, entry := range form.Entries() {
+		switch entry.Key {
+		case Keyword("as"), Keyword("or"):
+		case Keyword("keys"), Keyword("strs"), Keyword("syms"):
+			names, e := GetSlice(entry.Value)
+			if e != nil {
+				return nil, NewError("syntax", printer.Pr_str(entry.Key, true)+" must be followed by a vector of symbols")
+			}
+			for _, name := range names {
+				var sym Symbol
+				switch n := name.(type) {
+				case Symbol:
+					sym = n
+				case Keyword:
+					sym = NewSymbol(string(n))
+				default:
+					return nil, NewError("syntax", printer.Pr_str(entry.Key, true)+" must be followed by a vector of symbols")
+				}
+				var key MalType
+				switch entry.Key {
+				case Keyword("keys"):
+					key = Keyword(sym.Val)
+				case Keyword("strs"):
+					key = String(sym.Val)
+				default:
+					key = List{Val: []MalType{NewSymbol("quote"), sym}}
+				}
+				res = append(res, sym, lookup(sym, key))
+			}
+		default:
+			var e error
+			if res, e = bind_form(res, entry.Key, lookup(entry.Key, entry.Value)); e != nil {
+				return nil, e
+			}
+		}
+	}
+	return res, nil
+}
+
+// nth_fn gives the element of a collection at an index, or nil
+var nth_fn = &Func{Fn: func(a []MalType) (MalType, error) {
+	elems, e := destructure_seq(a[0])
+	if e != nil || int(a[1].(Int)) >= len(elems) {
+		return nil, e
+	}
+	return elems[a[1].(Int)], nil
+}}
+
+// nthnext_fn gives the elements of a collection from an index on, or
+// nil when there are none
+var nthnext_fn = &Func{Fn: func(a []MalType) (MalType, error) {
+	elems, e := destructure_seq(a[0])
+	if e != nil || int(a[1].(Int)) >= len(elems) {
+		return nil, e
+	}
+	return List{Val: elems[a[1].(Int):]}, nil
+}}
+
+func destructure_seq(coll MalType) ([]MalType, error) {
+	switch c := coll.(type) {
+	case nil:
+		return nil, nil
+	case List:
+		return c.Slice(), nil
+	case Vector:
+		return c.Val, nil
+	case Seqable:
+		if s := c.Seq(); s != nil {
+			return s.(List).Slice(), nil
+		}
+		return nil, nil
+	default:
+		return nil, NewError("type", "cannot destructure "+TypeOf(coll)+" as a sequence")
+	}
+}
+
+// map_fn gives the map a value is destructured as: a list, such as the
+// rest arguments of a function, is read as keys and values
+var map_fn = &Func{Fn: func(a []MalType) (MalType, error) {
+	if lst, ok := a[0].(List); ok {
+		if lst.Count()%2 != 0 {
+			return nil, NewError("type", "no value supplied for key "+printer.Pr_str(lst.Slice()[lst.Count()-1], true))
+		}
+		return NewHashMap(lst)
+	}
+	return a[0], nil
+}}
+
+// get_fn looks a key up in a map being destructured, giving the
+// default, if any, when it is missing
+var get_fn = &Func{Fn: func(a []MalType) (MalType, error) {
+	var v MalType = nil
+	found := false
+	switch m := a[0].(type) {
+	case nil:
+	case ILookup:
+		v, found = m.ValAt(a[1])
+	default:
+		return nil, NewError("type", "cannot destructure "+TypeOf(m)+" as a map")
+	}
+	if !found && len(a) == 3 {
+		return a[2], nil
+	}
+	return v, nil
+}}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	. "mal/src/env"
+	. "mal/src/types"
+)
+
+// The macroexpand-1, macroexpand and macroexpand-all special forms.
+// They take their form unevaluated and expand it when they are run,
+// so that they see the macros defined by then, like a call compiled
+// before its macro is defined does.
+
+// The body of a macro defined by defmacro! with a fn* form also binds
+// &form, the call being expanded, and &env, a map of the symbols bound
+// locally where it is to true:
+//
+//	(let* [[&form &env] (macro-env)] body)
+//
+// where macro-env is macro_env_fn. They are nil when the macro is not
+// being expanded but called, such as with apply.
+
+// expansion is a macro call being expanded
+type expansion struct {
+	form   List
+	locals map[uint32]bool // the Ids of the local symbols
+}
+
+// expansions are the macro calls being expanded, innermost last
+var expansions = []*expansion{}
+
+// expand_macro expands form, a call to mac, where the symbols with the
+// Ids in locals are bound locally
+func expand_macro(mac *MalFunc, form List, locals map[uint32]bool) (MalType, error) {
+	expansions = append(expansions, &expansion{form, locals})
+	defer func() { expansions = expansions[:len(expansions)-1] }()
+	return Apply(mac, form.Slice()[1:])
+}
+
+func macro_body(body MalType) MalType {
+	binds := Vector{Val: []MalType{
+		Vector{Val: []MalType{NewSymbol("&form"), NewSymbol("&env")}},
+		call_form(macro_env_fn),
+	}}
+	return List{Val: []MalType{NewSymbol("let*"), binds, body}}
+}
+
+// macro_env_fn gives &form and &env for the innermost expansion. Only
+// the macro being expanded gets them, the first time it asks, so that
+// a macro it calls as a function does not.
+var macro_env_fn = &Func{Fn: func([]MalType) (MalType, error) {
+	if len(expansions) == 0 || expansions[len(expansions)-1] == nil {
+		return nil, nil
+	}
+	x := expansions[len(expansions)-1]
+	expansions[len(expansions)-1] = nil
+	kvs := []MalType{}
+	for id := range x.locals {
+		kvs = append(kvs, SymbolById(id), Bool(true))
+	}
+	return Vector{Val: []MalType{form_meta(x.form), HashMap{}.AssocAll(kvs...)}}, nil
+}}
+
+// form_meta adds the position of form to its metadata, when that is a
+// map without one
+func form_meta(form List) MalType {
+	meta, ok := form.Meta.(HashMap)
+	if form.Pos == nil || form.Meta != nil && !ok {
+		return form
+	}
+	if _, found := meta.ValAt(Keyword("line")); found {
+		return form
+	}
+	kvs := []MalType{Keyword("line"), Int(form.Pos.Line), Keyword("column"), Int(form.Pos.Col)}
+	if form.Pos.Source != "" {
+		kvs = append(kvs, Keyword("file"), String(form.Pos.Source))
+	}
+	form.Meta = meta.AssocAll(kvs...)
+	return form
+}
+
+// expander expands the forms appearing in one place of the code: a
+// symbol bound locally there does not name a macro
+type expander struct {
+	globals *Env
+	locals  map[uint32]bool // the Ids of the local symbols
+}
+
+// bind gives a copy of x for the scope of the binding forms, where the
+// symbols they bind are local too
+func (x *expander) bind(forms ...MalType) *expander {
+	locals := map[uint32]bool{}
+	for id := range x.locals {
+		locals[id] = true
+	}
+	for _, form := range forms {
+		// a malformed binding binds nothing; compiling it fails
+		binds, _ := destructure([]MalType{form, nil})
+		for i := 0; i < len(binds); i += 2 {
+			locals[binds[i].(Symbol).Id] = true
+		}
+	}
+	return &expander{x.globals, locals}
+}
+
+// macroexpand runs the special form op on form
+func (x *expander) macroexpand(op string, form MalType) (MalType, error) {
+	switch op {
+	case "macroexpand-1":
+		return x.expand_1(form)
+	case "macroexpand":
+		return x.expand(form)
+	default:
+		return x.expand_all(form)
+	}
+}
+
+// macro gives the macro form is a call to, or nil
+func (x *expander) macro(form MalType) *MalFunc {
+	lst, ok := form.(List)
+	if !ok || lst.Count() == 0 {
+		return nil
+	}
+	sym, ok := lst.Slice()[0].(Symbol)
+	if !ok || x.locals[sym.Id] {
+		return nil
+	}
+	val, e := global_var(x.globals, sym).Get()
+	if fn, ok := val.(*MalFunc); e == nil && ok && fn.GetMacro() {
+		return fn
+	}
+	return nil
+}
+
+// expand_1 expands form once if it is a macro call
+func (x *expander) expand_1(form MalType) (MalType, error) {
+	if mac := x.macro(form); mac != nil {
+		return expand_macro(mac, form.(List), x.locals)
+	}
+	return form, nil
+}
+
+// expand expands form until it is no longer a macro call
+func (x *expander) expand(form MalType) (MalType, error) {
+	for mac := x.macro(form); mac != nil; mac = x.macro(form) {
+		var e error
+		if form, e = expand_macro(mac, form.(List), x.locals); e != nil {
+			return nil, e
+		}
+	}
+	return form, nil
+}
+
+// expand_all expands form and the forms nested in it. Special forms
+// are kept, with only their subforms that are evaluated expanded.
+func (x *expander) expand_all(form MalType) (MalType, error) {
+	form, e := x.expand(form)
+	if e != nil {
+		return nil, e
+	}
+	switch f := form.(type) {
+	case List:
+		if f.Count() == 0 {
+			return form, nil
+		}
+		head := ""
+		if sym, ok := f.Slice()[0].(Symbol); ok {
+			head = sym.Val
+		}
+		switch head {
+		case "quote", "quasiquote", "macroexpand-1", "macroexpand", "macroexpand-all":
+			return form, nil
+		case "let*", "loop*":
+			return x.expand_let(f)
+		case "fn*":
+			return x.expand_fn(f)
+		case "try*":
+			return x.expand_try(f)
+		case "def!", "defmacro!", "if", "do", "recur":
+			return x.expand_from(f, 1)
+		default:
+			return x.expand_from(f, 0)
+		}
+	case Vector:
+		vals, e := x.expand_each(f.Val)
+		if e != nil {
+			return nil, e
+		}
+		f.Val = vals
+		return f, nil
+	case HashMap:
+		kvs := []MalType{}
+		for _, entry := range f.Entries() {
+			key, e := x.expand_all(entry.Key)
+			if e != nil {
+				return nil, e
+			}
+			val, e := x.expand_all(entry.Value)
+			if e != nil {
+				return nil, e
+			}
+			kvs = append(kvs, key, val)
+		}
+		return HashMap{}.AssocAll(kvs...), nil
+	default:
+		return form, nil
+	}
+}
+
+func (x *expander) expand_each(forms []MalType) ([]MalType, error) {
+	res := make([]MalType, len(forms))
+	for i, form := range forms {
+		var e error
+		if res[i], e = x.expand_all(form); e != nil {
+			return nil, e
+		}
+	}
+	return res, nil
+}
+
+// expand_from expands the elements of lst from index i on
+func (x *expander) expand_from(lst List, i int) (MalType, error) {
+	forms := lst.Slice()
+	if i > len(forms) {
+		return lst, nil
+	}
+	rest, e := x.expand_each(forms[i:])
+	if e != nil {
+		return nil, e
+	}
+	return List{Val: append(append([]MalType{}, forms[:i]...), rest...), Meta: lst.Meta, Pos: lst.Pos}, nil
+}
+
+// expand_let expands the values of the bindings and the body of a let*
+// or loop*
+func (x *expander) expand_let(lst List) (MalType, error) {
+	if lst.Count() < 2 {
+		return lst, nil
+	}
+	binds, e := GetSlice(lst.Slice()[1])
+	if e != nil {
+		return lst, nil
+	}
+	vals := append([]MalType{}, binds...)
+	inner := x
+	for i := 0; i < len(vals); i += 2 {
+		if i+1 < len(vals) {
+			if vals[i+1], e = inner.expand_all(vals[i+1]); e != nil {
+				return nil, e
+			}
+		}
+		inner = inner.bind(vals[i])
+	}
+	res, e := inner.expand_from(lst, 2)
+	if e != nil {
+		return nil, e
+	}
+	l := res.(List)
+	switch b := l.Val[1].(type) {
+	case Vector:
+		b.Val = vals
+		l.Val[1] = b
+	case List:
+		l.Val[1] = List{Val: vals, Meta: b.Meta, Pos: b.Pos}
+	}
+	return l, nil
+}
+
+// expand_fn expands the bodies of a fn*
+func (x *expander) expand_fn(lst List) (MalType, error) {
+	forms := lst.Slice()
+	if !fn_multi(forms[1:]) {
+		if len(forms) < 2 {
+			return lst, nil
+		}
+		return x.bind(forms[1]).expand_from(lst, 2)
+	}
+	clauses := []MalType{forms[0]}
+	for _, clause := range forms[1:] {
+		c, e := x.bind(clause.(List).Slice()[0]).expand_from(clause.(List), 1)
+		if e != nil {
+			return nil, e
+		}
+		clauses = append(clauses, c)
+	}
+	return List{Val: clauses, Meta: lst.Meta, Pos: lst.Pos}, nil
+}
+
+// expand_try expands the body of a try* and its clauses
+func (x *expander) expand_try(lst List) (MalType, error) {
+	forms := lst.Slice()
+	res := []MalType{forms[0]}
+	for i, form := range forms[1:] {
+		clause, ok := form.(List)
+		var e error
+		switch {
+		case i > 0 && ok && starts_with(clause.Slice(), "catch*") && clause.Count() > 2:
+			sym := clause.Slice()[clause.Count()-2]
+			form, e = x.bind(sym).expand_from(clause, clause.Count()-1)
+		case i > 0 && ok && starts_with(clause.Slice(), "finally*"):
+			form, e = x.expand_from(clause, 1)
+		default:
+			form, e = x.expand_all(form)
+		}
+		if e != nil {
+			return nil, e
+		}
+		res = append(res, form)
+	}
+	return List{Val: res, Meta: lst.Meta, Pos: lst.Pos}, nil
+}
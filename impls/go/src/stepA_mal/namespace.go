@@ -0,0 +1,340 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+import (
+	. "mal/src/env"
+	"mal/src/printer"
+	. "mal/src/types"
+)
+
+// Namespaces. Each namespace has its own table of globals, the Env at
+// the root of the code compiled in it. A symbol names a global defined
+// in that namespace, one referred into it by require, or a core one;
+// a symbol qualified with the name or an alias of a namespace, as in
+// str/join, names a public global of that namespace.
+//
+// Like any global, the Var a symbol names is found when the code is
+// compiled: a core global that is then defined again in the namespace
+// keeps its old meaning in the code compiled before.
+
+type namespace struct {
+	name    string
+	env     *Env
+	aliases map[string]*namespace
+	refers  map[uint32]referred
+	defined map[uint32]bool // the globals a def! has been compiled for
+	private map[uint32]bool
+}
+
+// referred is a global of another namespace, referred by require
+type referred struct {
+	v  *Var
+	ns *namespace
+}
+
+const (
+	core_ns = "core" // the builtins and the globals defined with them
+	user_ns = "user" // where the REPL and scripts start
+)
+
+var namespaces = map[string]*namespace{}
+
+// the namespaces by their globals, for the compilers, which only know
+// the globals of the code
+var env_namespaces = map[*Env]*namespace{}
+
+// current is the namespace forms are compiled in, *ns*
+var current *namespace
+
+// create_ns finds a namespace, making it if there is none
+func create_ns(name string) *namespace {
+	if ns, ok := namespaces[name]; ok {
+		return ns
+	}
+	env, _ := NewEnv(nil, nil, nil)
+	ns := &namespace{name, env.(*Env), map[string]*namespace{}, map[uint32]referred{}, map[uint32]bool{}, map[uint32]bool{}}
+	namespaces[name] = ns
+	env_namespaces[ns.env] = ns
+	return ns
+}
+
+// as_symbol gives the symbol named by a builtin argument of kind
+// symbol, which may be a string
+func as_symbol(name MalType) Symbol {
+	if s, ok := name.(String); ok {
+		return NewSymbol(string(s))
+	}
+	return name.(Symbol)
+}
+
+func find_ns(name MalType) (*namespace, error) {
+	sym := as_symbol(name)
+	ns, ok := namespaces[sym.Val]
+	if !ok {
+		return nil, NewError("namespace", "namespace "+sym.Val+" not found")
+	}
+	return ns, nil
+}
+
+func set_current(ns *namespace) {
+	current = ns
+	namespaces[core_ns].env.Set(NewSymbol("*ns*"), NewSymbol(ns.name))
+}
+
+func ns_of(globals *Env) *namespace {
+	if ns, ok := env_namespaces[globals]; ok {
+		return ns
+	}
+	return current
+}
+
+// split_qualified splits ns/name, ok being false for a symbol that is
+// not qualified, such as / itself
+func split_qualified(sym Symbol) (prefix string, name Symbol, ok bool) {
+	prefix, n, ok := strings.Cut(sym.Val, "/")
+	if !ok || prefix == "" || n == "" {
+		return "", sym, false
+	}
+	name = NewSymbol(n)
+	name.Meta = sym.Meta
+	return prefix, name, true
+}
+
+// public gives the Var of a public global of ns, or nil
+func (ns *namespace) public(sym Symbol) *Var {
+	if v := ns.env.LookupVar(sym); v != nil && v.Bound && !ns.private[sym.Id] {
+		return v
+	}
+	return nil
+}
+
+// lookup finds the global sym names in ns and the namespace it is in.
+// The Var is nil when there is no such global yet, and the namespace
+// too when sym is qualified with an unknown one.
+func (ns *namespace) lookup(sym Symbol) (*Var, *namespace) {
+	if prefix, name, ok := split_qualified(sym); ok {
+		target := ns.aliases[prefix]
+		if target == nil {
+			target = namespaces[prefix]
+		}
+		switch target {
+		case nil:
+			return nil, nil
+		case ns:
+			return ns.env.LookupVar(name), ns
+		default:
+			return target.public(name), target
+		}
+	}
+	if v := ns.env.LookupVar(sym); v != nil && (v.Bound || ns.defined[sym.Id]) {
+		return v, ns
+	}
+	if r, ok := ns.refers[sym.Id]; ok {
+		return r.v, r.ns
+	}
+	if core := namespaces[core_ns]; core != ns {
+		if v := core.public(sym); v != nil {
+			return v, core
+		}
+	}
+	return nil, ns
+}
+
+// resolve gives the Var sym names in ns. A global that is not defined
+// yet gets an unbound Var in ns, for a later def! to set, unless it is
+// qualified with another namespace.
+func (ns *namespace) resolve(sym Symbol) *Var {
+	v, home := ns.lookup(sym)
+	switch {
+	case v != nil:
+		return v
+	case home != ns:
+		return &Var{Name: sym.Val}
+	default:
+		_, name, _ := split_qualified(sym)
+		return ns.env.Var(name)
+	}
+}
+
+// define gives the Var a def! of sym sets. ^:private metadata on sym
+// keeps the global from other namespaces.
+func (ns *namespace) define(sym Symbol) (*Var, error) {
+	if prefix, name, ok := split_qualified(sym); ok {
+		if prefix != ns.name && ns.aliases[prefix] != ns {
+			return nil, NewError("syntax", "cannot define "+sym.Val+" outside its namespace")
+		}
+		sym = name
+	}
+	private := false
+	if meta, ok := sym.Meta.(HashMap); ok {
+		p, _ := meta.ValAt(Keyword("private"))
+		private = p != nil && p != Bool(false)
+	}
+	ns.defined[sym.Id], ns.private[sym.Id] = true, private
+	return ns.env.Var(sym), nil
+}
+
+// qualify gives the name of the global sym names, qualified with its
+// namespace, or with ns when there is no such global yet
+func (ns *namespace) qualify(sym Symbol) Symbol {
+	_, home := ns.lookup(sym)
+	if home == nil {
+		home = ns
+	}
+	qualified := NewSymbol(home.name + "/" + sym.Val)
+	qualified.Meta = sym.Meta
+	return qualified
+}
+
+// global_var gives the Var of a global named in code compiled with
+// globals
+func global_var(globals *Env, sym Symbol) *Var {
+	return ns_of(globals).resolve(sym)
+}
+
+// define_var gives the Var set by a def! compiled with globals
+func define_var(globals *Env, sym Symbol) (*Var, error) {
+	return ns_of(globals).define(sym)
+}
+
+// load_root is the directory require finds the files of namespaces
+// in: that of the script being run, or the current one
+var load_root = ""
+
+// ns_file gives the file of a namespace: a.b-c is in a/b_c.mal
+func ns_file(name string) string {
+	path := strings.ReplaceAll(strings.ReplaceAll(name, ".", "/"), "-", "_")
+	return filepath.Join(load_root, path+".mal")
+}
+
+func in_ns(a []MalType) (MalType, error) {
+	sym := as_symbol(a[0])
+	set_current(create_ns(sym.Val))
+	return sym, nil
+}
+
+// require makes namespaces available in the current one, loading the
+// file of those that do not exist yet. A spec is the name of a
+// namespace, or a vector of the name and the options :as alias and
+// :refer, with a vector of symbols or :all.
+func require(a []MalType) (MalType, error) {
+	for _, spec := range a {
+		var opts []MalType
+		name, ok := spec.(Symbol)
+		if v, is_vec := spec.(Vector); is_vec && len(v.Val) > 0 {
+			name, ok = v.Val[0].(Symbol)
+			opts = v.Val[1:]
+		}
+		if !ok {
+			return nil, errors.New("require: a spec must be a symbol or a vector starting with one, got " + printer.Pr_str(spec, true))
+		}
+		target, e := require_ns(name.Val)
+		if e != nil {
+			return nil, e
+		}
+		if len(opts)%2 != 0 {
+			return nil, errors.New("require: missing value for option " + printer.Pr_str(opts[len(opts)-1], true))
+		}
+		for i := 0; i < len(opts); i += 2 {
+			if e := refer(target, opts[i], opts[i+1]); e != nil {
+				return nil, e
+			}
+		}
+	}
+	return nil, nil
+}
+
+func require_ns(name string) (*namespace, error) {
+	if ns, ok := namespaces[name]; ok {
+		return ns, nil
+	}
+	file := ns_file(name)
+	if _, e := os.Stat(file); e != nil {
+		return nil, NewError("namespace", "require: namespace "+name+" not found (no file "+file+")")
+	}
+	if _, e := load(file); e != nil {
+		return nil, e
+	}
+	ns, ok := namespaces[name]
+	if !ok {
+		return nil, NewError("namespace", "require: "+file+" does not declare namespace "+name)
+	}
+	return ns, nil
+}
+
+// refer applies a require option for target to the current namespace
+func refer(target *namespace, opt MalType, val MalType) error {
+	switch opt {
+	case Keyword("as"):
+		alias, ok := val.(Symbol)
+		if !ok {
+			return errors.New("require: :as must be followed by a symbol")
+		}
+		current.aliases[alias.Val] = target
+	case Keyword("refer"):
+		if val == Keyword("all") {
+			for _, v := range target.env.Vars() {
+				if sym := NewSymbol(v.Name); target.public(sym) != nil {
+					current.refers[sym.Id] = referred{v, target}
+				}
+			}
+			return nil
+		}
+		syms, e := GetSlice(val)
+		if e != nil {
+			return errors.New("require: :refer must be followed by a vector of symbols or :all")
+		}
+		for _, s := range syms {
+			sym, ok := s.(Symbol)
+			if !ok {
+				return errors.New("require: :refer must be followed by a vector of symbols or :all")
+			}
+			v := target.public(sym)
+			if v == nil {
+				return NewError("undefined-symbol", "require: "+target.name+"/"+sym.Val+" does not exist or is not public")
+			}
+			current.refers[sym.Id] = referred{v, target}
+		}
+	default:
+		return errors.New("require: unknown option " + printer.Pr_str(opt, true))
+	}
+	return nil
+}
+
+// ns_publics gives the public globals of a namespace, as a map of their
+// symbols to their values
+func ns_publics(a []MalType) (MalType, error) {
+	ns, e := find_ns(a[0])
+	if e != nil {
+		return nil, e
+	}
+	kvs := []MalType{}
+	for _, v := range ns.env.Vars() {
+		if sym := NewSymbol(v.Name); ns.public(sym) != nil {
+			kvs = append(kvs, sym, v.Val)
+		}
+	}
+	return HashMap{}.AssocAll(kvs...), nil
+}
+
+// ns_resolve gives the qualified name of the global a symbol names in a
+// namespace, or nil when it names none
+func ns_resolve(a []MalType) (MalType, error) {
+	ns, e := find_ns(a[0])
+	if e != nil {
+		return nil, e
+	}
+	sym := as_symbol(a[1])
+	v, home := ns.lookup(sym)
+	if v == nil || !v.Bound {
+		return nil, nil
+	}
+	_, name, _ := split_qualified(sym)
+	return NewSymbol(home.name + "/" + name.Val), nil
+}
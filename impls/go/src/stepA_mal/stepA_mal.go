@@ -2,8 +2,10 @@ package main
 
 import (
 	"errors"
+	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 )
 
@@ -33,281 +35,254 @@ func starts_with(xs []MalType, sym string) bool {
 	return false
 }
 
-func qq_loop(xs []MalType) MalType {
+// syntax_quote is the state of expanding one quasiquote form
+type syntax_quote struct {
+	gensyms map[string]Symbol // the symbol each x# stands for
+	ns      *namespace        // to qualify free symbols in, or nil
+}
+
+// the names that are not qualified in a quasiquote
+var special_forms = map[string]bool{
+	"def!": true, "defmacro!": true, "let*": true, "loop*": true, "recur": true,
+	"quote": true, "quasiquote": true, "unquote": true, "splice-unquote": true,
+	"try*": true, "catch*": true, "finally*": true, "do": true, "if": true,
+	"fn*": true, "macroexpand-1": true, "macroexpand": true, "macroexpand-all": true,
+	"&": true,
+}
+
+// symbol gives what sym stands for in a quasiquote: an auto-gensym x#
+// is the same new symbol throughout, and other symbols are qualified
+// with the namespace of the global they name when *qualify-quasiquote*
+// is set
+func (sq *syntax_quote) symbol(sym Symbol) Symbol {
+	name := sym.Val
+	if len(name) > 1 && strings.HasSuffix(name, "#") {
+		g, ok := sq.gensyms[name]
+		if !ok {
+			g = NewSymbol(core.Gensym(name[:len(name)-1]+"__").Val + "__auto__")
+			sq.gensyms[name] = g
+		}
+		return g
+	}
+	if sq.ns == nil || special_forms[name] || strings.Contains(name, "/") || strings.HasPrefix(name, ".") {
+		return sym
+	}
+	return sq.ns.qualify(sym)
+}
+
+func qq_loop(xs []MalType, sq *syntax_quote) MalType {
 	acc := NewList()
 	for i := len(xs) - 1; 0<=i; i -= 1 {
 		elt := xs[i]
 		switch e := elt.(type) {
 		case List:
-			if starts_with(e.Val, "splice-unquote") {
-				acc = NewList(Symbol{"concat"}, e.Val[1], acc)
+			if starts_with(e.Slice(), "splice-unquote") {
+				acc = NewList(NewSymbol("concat"), e.Slice()[1], acc)
 				continue
 			}
 		default:
 		}
-		acc = NewList(Symbol{"cons"}, quasiquote(elt), acc)
+		acc = NewList(NewSymbol("cons"), qq(elt, sq), acc)
 	}
 	return acc
 }
 
-func quasiquote(ast MalType) MalType {
+func qq(ast MalType, sq *syntax_quote) MalType {
 	switch a := ast.(type) {
 	case Vector:
-		return NewList(Symbol{"vec"}, qq_loop(a.Val))
-	case HashMap, Symbol:
-		return NewList(Symbol{"quote"}, ast)
+		return NewList(NewSymbol("vec"), qq_loop(a.Val, sq))
+	case Symbol:
+		return NewList(NewSymbol("quote"), sq.symbol(a))
+	case HashMap:
+		return NewList(NewSymbol("quote"), ast)
 	case List:
-		if starts_with(a.Val,"unquote") {
-			return a.Val[1]
+		if starts_with(a.Slice(),"unquote") {
+			return a.Slice()[1]
 		} else {
-			return qq_loop(a.Val)
+			return qq_loop(a.Slice(), sq)
 		}
 	default:
 		return ast
 	}
 }
 
-func map_eval(xs []MalType, env EnvType) ([]MalType, error) {
-	lst := []MalType{}
-	for _, a := range xs {
-		exp, e := EVAL(a, env)
-		if e != nil {
-			return nil, e
-		}
-		lst = append(lst, exp)
+// quasiquote expands a quasiquote form into the code building it
+func quasiquote(ast MalType, globals *Env) MalType {
+	sq := &syntax_quote{map[string]Symbol{}, nil}
+	if q, _ := global_var(globals, NewSymbol("*qualify-quasiquote*")).Get(); q != nil && q != Bool(false) {
+		sq.ns = ns_of(globals)
 	}
-	return lst, nil
+	return qq(ast, sq)
 }
 
+var use_vm = flag.Bool("vm", false, "run on the bytecode VM (see vm.go)")
+
+// EVAL compiles ast (see compile.go) with env as its global
+// environment, then runs it
 func EVAL(ast MalType, env EnvType) (MalType, error) {
-	for {
-	//fmt.Printf("EVAL: %v\n", printer.Pr_str(ast, true))
+	if *use_vm {
+		return VM_EVAL(ast, env)
+	}
+	globals, ok := env.(*Env)
+	if !ok {
+		return nil, errors.New("EVAL requires a global Env")
+	}
+	lam := &lambda{globals: globals}
+	lam.body = compile(ast, &scope{lam: lam}, true)
+	if lam.err != nil {
+		return nil, lam.err
+	}
+	return run(new_frame(lam, globals, make([]MalType, len(lam.ids))))
+}
 
-	if Symbol_Q(ast) {
-		return env.Get(ast.(Symbol))
-	} else if Vector_Q(ast) {
-		lst, e := map_eval(ast.(Vector).Val, env)
-		if e != nil {
-			return nil, e
-		}
-		return Vector{lst, nil}, nil
-	} else if HashMap_Q(ast) {
-		m := ast.(HashMap)
-		new_hm := HashMap{map[string]MalType{}, nil}
-		for k, v := range m.Val {
-			kv, e2 := EVAL(v, env)
-			if e2 != nil {
-				return nil, e2
-			}
-			new_hm.Val[k] = kv
-		}
-		return new_hm, nil
-	} else if !List_Q(ast) {
-		return ast, nil
-	} else {
-		// apply list
-		if len(ast.(List).Val) == 0 {
-			return ast, nil
-		}
+// print
+func PRINT(exp MalType) (string, error) {
+	return printer.Pr_str(exp, true), nil
+}
 
-		a0 := ast.(List).Val[0]
-		var a1 MalType = nil
-		var a2 MalType = nil
-		switch len(ast.(List).Val) {
-		case 1:
-			a1 = nil
-			a2 = nil
-		case 2:
-			a1 = ast.(List).Val[1]
-			a2 = nil
-		default:
-			a1 = ast.(List).Val[1]
-			a2 = ast.(List).Val[2]
+// the last error print_error printed, for stack-trace
+var last_error error
+
+// print_error prints an uncaught error as pr-str would, an ex-info
+// with its data and cause, and its stack trace. The error is kept: *e
+// is set to the value catch* would have bound.
+func print_error(e error) {
+	exc := exception(e)
+	fmt.Printf("Error: %s\n", printer.Pr_str(exc, true))
+	if te, ok := e.(*TracedError); ok {
+		for _, fr := range te.Trace {
+			fmt.Printf("  %v\n", fr)
 		}
-		a0sym := "__<*fn*>__"
-		if Symbol_Q(a0) {
-			a0sym = a0.(Symbol).Val
+	}
+	last_error = e
+	namespaces[core_ns].env.Set(NewSymbol("*e"), exc)
+}
+
+// stack_trace gives the stack trace of the last uncaught error as a
+// list of maps, innermost call first
+func stack_trace(a []MalType) (MalType, error) {
+	frames := []MalType{}
+	te, ok := last_error.(*TracedError)
+	if !ok {
+		return List{Val: frames}, nil
+	}
+	for _, fr := range te.Trace {
+		var fn MalType = nil
+		if fr.Fn != "" {
+			fn = String(fr.Fn)
 		}
-		switch a0sym {
-		case "def!":
-			res, e := EVAL(a2, env)
-			if e != nil {
-				return nil, e
-			}
-			return env.Set(a1.(Symbol), res), nil
-		case "let*":
-			let_env, e := NewEnv(env, nil, nil)
-			if e != nil {
-				return nil, e
-			}
-			arr1, e := GetSlice(a1)
-			if e != nil {
-				return nil, e
-			}
-			for i := 0; i < len(arr1); i += 2 {
-				if !Symbol_Q(arr1[i]) {
-					return nil, errors.New("non-symbol bind value")
-				}
-				exp, e := EVAL(arr1[i+1], let_env)
-				if e != nil {
-					return nil, e
-				}
-				let_env.Set(arr1[i].(Symbol), exp)
-			}
-			ast = a2
-			env = let_env
-		case "quote":
-			return a1, nil
-		case "quasiquote":
-			ast = quasiquote(a1)
-		case "defmacro!":
-			fn, e := EVAL(a2, env)
-			fn = fn.(MalFunc).SetMacro()
-			if e != nil {
-				return nil, e
-			}
-			return env.Set(a1.(Symbol), fn), nil
-		case "try*":
-			var exc MalType
-			exp, e := EVAL(a1, env)
-			if e == nil {
-				return exp, nil
-			} else {
-				if a2 != nil && List_Q(a2) {
-					a2s, _ := GetSlice(a2)
-					if Symbol_Q(a2s[0]) && (a2s[0].(Symbol).Val == "catch*") {
-						switch e.(type) {
-						case MalError:
-							exc = e.(MalError).Obj
-						default:
-							exc = e.Error()
-						}
-						binds := NewList(a2s[1])
-						new_env, e := NewEnv(env, binds, NewList(exc))
-						if e != nil {
-							return nil, e
-						}
-						exp, e = EVAL(a2s[2], new_env)
-						if e == nil {
-							return exp, nil
-						}
-					}
-				}
-				return nil, e
-			}
-		case "do":
-			lst := ast.(List).Val
-			_, e := map_eval(lst[1 : len(lst)-1], env)
-			if e != nil {
-				return nil, e
-			}
-			if len(lst) == 1 {
-				return nil, nil
-			}
-			ast = lst[len(lst)-1]
-		case "if":
-			cond, e := EVAL(a1, env)
-			if e != nil {
-				return nil, e
-			}
-			if cond == nil || cond == false {
-				if len(ast.(List).Val) >= 4 {
-					ast = ast.(List).Val[3]
-				} else {
-					return nil, nil
-				}
-			} else {
-				ast = a2
-			}
-		case "fn*":
-			fn := MalFunc{EVAL, a2, env, a1, false, NewEnv, nil}
-			return fn, nil
-		default:
-			f, e := EVAL(a0, env)
-			if e != nil {
-				return nil, e
-			}
-			args := ast.(List).Val[1:]
-			if MalFunc_Q(f) && f.(MalFunc).GetMacro() {
-				new_ast, e := Apply(f.(MalFunc), args)
-				if e != nil {
-					return nil, e
-				}
-				ast = new_ast
-				continue
-			}
-			args, e = map_eval(args, env)
-			if e != nil {
-				return nil, e
-			}
-			if MalFunc_Q(f) {
-				fn := f.(MalFunc)
-				ast = fn.Exp
-				env, e = NewEnv(fn.Env, fn.Params, List{args, nil})
-				if e != nil {
-					return nil, e
-				}
-			} else {
-				fn, ok := f.(Func)
-				if !ok {
-					return nil, errors.New("attempt to call non-function")
-				}
-				return fn.Fn(args)
+		entry := HashMap{}.AssocAll(Keyword("fn"), fn, Keyword("form"), fr.Form)
+		if fr.Pos != nil {
+			entry = entry.AssocAll(Keyword("line"), Int(fr.Pos.Line), Keyword("column"), Int(fr.Pos.Col))
+			if fr.Pos.Source != "" {
+				entry = entry.AssocAll(Keyword("file"), String(fr.Pos.Source))
 			}
 		}
+		frames = append(frames, entry)
 	}
-	} // TCO loop
+	return List{Val: frames}, nil
 }
 
-// print
-func PRINT(exp MalType) (string, error) {
-	return printer.Pr_str(exp, true), nil
+func load_file(a []MalType) (MalType, error) {
+	return load(string(a[0].(String)))
+}
+
+func eval(a []MalType) (MalType, error) {
+	return EVAL(a[0], current.env)
 }
 
-var repl_env, _ = NewEnv(nil, nil, nil)
+// the builtins that need the interpreter, declared to the core so that
+// their arguments are checked like those of the others
+var interp_builtins = []struct {
+	name, params, doc string
+	fn                func([]MalType) (MalType, error)
+}{
+	{"eval", "form", "Evaluates form in the current namespace.", eval},
+	{"load-file", "file:string", "Evaluates the forms of file in the current namespace, or the one it declares, and returns the value of the last.", load_file},
+	{"stack-trace", "", "Returns the stack trace of the last uncaught error, as a list of maps, innermost call first.", stack_trace},
+	{"in-ns", "name:symbol", "Makes the namespace name current, creating it if it does not exist.", in_ns},
+	{"require", "& specs", "Loads namespaces, given as name or [name :as alias :refer [syms]], and makes them available in the current one.", require},
+	{"ns-publics", "ns:symbol", "Returns a map of the symbols of the public globals of the namespace ns to their values.", ns_publics},
+	{"ns-resolve", "ns:symbol sym:symbol", "Returns the qualified symbol of the global sym names in the namespace ns, or nil.", ns_resolve},
+}
+
+// load runs the forms of a file in the current namespace, or in the
+// one the file switches to with ns or in-ns. The current namespace is
+// restored after.
+func load(file string) (MalType, error) {
+	defer set_current(current)
+	b, e := os.ReadFile(file)
+	if e != nil {
+		return nil, e
+	}
+	ast, e := reader.Read_source(string(b), file)
+	if e != nil {
+		return nil, e
+	}
+	// the forms are compiled one at a time, so that each sees the
+	// macros and settings such as *qualify-quasiquote* of those before
+	var res MalType = nil
+	for _, form := range ast.(List).Slice()[1:] {
+		if res, e = EVAL(form, current.env); e != nil {
+			return nil, e
+		}
+	}
+	return res, nil
+}
 
 // repl
-func rep(str string) (MalType, error) {
+func rep(str string) (string, error) {
 	var exp MalType
 	var res string
 	var e error
 	if exp, e = READ(str); e != nil {
-		return nil, e
+		return "", e
 	}
-	if exp, e = EVAL(exp, repl_env); e != nil {
-		return nil, e
+	if exp, e = EVAL(exp, current.env); e != nil {
+		return "", e
 	}
 	if res, e = PRINT(exp); e != nil {
-		return nil, e
+		return "", e
 	}
 	return res, nil
 }
 
 func main() {
+	flag.Parse()
+
+	// the builtins are in the core namespace
+	core_env := create_ns(core_ns).env
+	set_current(namespaces[core_ns])
+
 	// core.go: defined using go
 	for k, v := range core.NS {
-		repl_env.Set(Symbol{k}, Func{v.(func([]MalType) (MalType, error)), nil})
+		core_env.Set(NewSymbol(k), &Func{v, nil})
+	}
+	for _, b := range interp_builtins {
+		core_env.Set(NewSymbol(b.name), &Func{core.Define(b.name, b.params, b.doc, b.fn), nil})
 	}
-	repl_env.Set(Symbol{"eval"}, Func{func(a []MalType) (MalType, error) {
-		return EVAL(a[0], repl_env)
-	}, nil})
-	repl_env.Set(Symbol{"*ARGV*"}, List{})
+	core_env.Set(NewSymbol("*ARGV*"), List{})
+	core_env.Set(NewSymbol("*e"), nil)
+	core_env.Set(NewSymbol("*qualify-quasiquote*"), Bool(false))
 
 	// core.mal: defined using the language itself
 	rep("(def! *host-language* \"go\")")
 	rep("(def! not (fn* (a) (if a false true)))")
-	rep("(def! load-file (fn* (f) (eval (read-string (str \"(do \" (slurp f) \"\nnil)\")))))")
 	rep("(defmacro! cond (fn* (& xs) (if (> (count xs) 0) (list 'if (first xs) (if (> (count xs) 1) (nth xs 1) (throw \"odd number of forms to cond\")) (cons 'cond (rest (rest xs)))))))")
+	rep("(defmacro! doc (fn* (name) (list 'doc* (list 'quote name))))")
+	rep("(defmacro! ns (fn* (name & clauses) (cons 'do (cons (list 'in-ns (list 'quote name)) (map (fn* (c) (if (= (first c) :require) (cons 'require (map (fn* (spec) (list 'quote spec)) (rest c))) (throw (str \"ns: unsupported clause \" c)))) clauses)))))")
+	set_current(create_ns(user_ns))
 
 	// called with mal script to load and eval
-	if len(os.Args) > 1 {
-		args := make([]MalType, 0, len(os.Args)-2)
-		for _, a := range os.Args[2:] {
-			args = append(args, a)
+	if flag.NArg() > 0 {
+		args := make([]MalType, 0, flag.NArg()-1)
+		for _, a := range flag.Args()[1:] {
+			args = append(args, String(a))
 		}
-		repl_env.Set(Symbol{"*ARGV*"}, List{args, nil})
-		if _, e := rep("(load-file \"" + os.Args[1] + "\")"); e != nil {
-			fmt.Printf("Error: %v\n", e)
+		core_env.Set(NewSymbol("*ARGV*"), List{Val: args})
+		load_root = filepath.Dir(flag.Arg(0))
+		if _, e := load(flag.Arg(0)); e != nil {
+			print_error(e)
 			os.Exit(1)
 		}
 		os.Exit(0)
@@ -316,18 +291,18 @@ func main() {
 	// repl loop
 	rep("(println (str \"Mal [\" *host-language* \"]\"))")
 	for {
-		text, err := readline.Readline("user> ")
+		text, err := readline.Readline(current.name + "> ")
 		text = strings.TrimRight(text, "\n")
 		if err != nil {
 			return
 		}
-		var out MalType
+		var out string
 		var e error
 		if out, e = rep(text); e != nil {
 			if e.Error() == "<empty line>" {
 				continue
 			}
-			fmt.Printf("Error: %v\n", e)
+			print_error(e)
 			continue
 		}
 		fmt.Printf("%v\n", out)
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+import (
+	. "mal/src/env"
+	. "mal/src/types"
+)
+
+// Stack-based VM running the bytecode made in bytecode.go. Calls
+// between compiled functions push a call_frame instead of recursing in
+// Go; the VM is only re-entered when Go code (core functions, macro
+// expansion) applies a compiled function.
+
+// cell holds a captured local, shared by the frame and its closures
+type cell struct {
+	val MalType
+}
+
+func (c *cell) Type() string           { return "cell" }
+func (c *cell) Equal(obj MalType) bool { return obj == MalType(c) }
+func (c *cell) Hash() uint32           { return 0 }
+func (c *cell) String() string         { return "#<cell>" }
+
+// caught is an error a handler took, which stays on the stack until a
+// catch* clause binds its value, or is raised again as it is, with its
+// stack trace
+type caught struct {
+	err error
+}
+
+func (c *caught) Type() string           { return "caught" }
+func (c *caught) Equal(obj MalType) bool { return obj == MalType(c) }
+func (c *caught) Hash() uint32           { return 0 }
+func (c *caught) String() string         { return "#<caught>" }
+
+// closure is the Env of the MalFunc values made by OP_CLOSURE
+type closure struct {
+	p      *proto
+	upvals []*cell
+}
+
+func (cl *closure) Find(key Symbol) EnvType {
+	for _, id := range cl.p.ids {
+		if id == key.Id {
+			return cl
+		}
+	}
+	return cl.p.globals.Find(key)
+}
+
+func (cl *closure) Set(key Symbol, value MalType) MalType {
+	return cl.p.globals.Set(key, value)
+}
+
+func (cl *closure) Get(key Symbol) (MalType, error) {
+	for i, id := range cl.p.ids {
+		if id == key.Id {
+			return cl.upvals[i].val, nil
+		}
+	}
+	return cl.p.globals.Get(key)
+}
+
+// arities is the Env of the MalFunc values made by OP_ARITIES, with a
+// closure for each arity. It is an Env through the first one.
+type arities struct {
+	*closure
+	all []*closure
+}
+
+// pick gives the closure a call with n arguments runs, as pick_arity
+func (a *arities) pick(n int) *closure {
+	var variadic *closure = nil
+	for _, cl := range a.all {
+		if cl.p.variadic {
+			variadic = cl
+		} else if cl.p.nparams == n {
+			return cl
+		}
+	}
+	if variadic != nil && n >= variadic.p.nparams {
+		return variadic
+	}
+	return nil
+}
+
+func arities_bind(env EnvType, _ MalType, args_mt MalType) (EnvType, error) {
+	args, e := GetSlice(args_mt)
+	if e != nil {
+		return nil, e
+	}
+	a := env.(*arities)
+	cl := a.pick(len(args))
+	if cl == nil {
+		return nil, arity_error(len(args), a.p.name)
+	}
+	return vm_call{cl, args}, nil
+}
+
+// vm_call is what the GenEnv of a compiled function returns: the
+// closure with its arguments, ready for vm_eval to run
+type vm_call struct {
+	*closure
+	args []MalType
+}
+
+func vm_bind(env EnvType, _ MalType, args_mt MalType) (EnvType, error) {
+	args, e := GetSlice(args_mt)
+	if e != nil {
+		return nil, e
+	}
+	return vm_call{env.(*closure), args}, nil
+}
+
+func vm_eval(_ MalType, env EnvType) (MalType, error) {
+	c := env.(vm_call)
+	return vm.run(c.closure, c.args)
+}
+
+type call_frame struct {
+	cl   *closure
+	ip   int
+	base int // the first local; the function called is just below
+	// the locals there is room for, which code compiled since the frame
+	// was entered may need more of (see grow)
+	nlocals int
+}
+
+type machine struct {
+	stack  []MalType
+	frames []call_frame
+}
+
+var vm machine
+
+// VM_EVAL compiles ast to bytecode with env as its global environment
+// and runs it
+func VM_EVAL(ast MalType, env EnvType) (MalType, error) {
+	// the forms of a top-level do are compiled one after the other, so
+	// that the macros defined by one are expanded in the next
+	if lst, ok := ast.(List); ok && starts_with(lst.Slice(), "do") {
+		var res MalType = nil
+		for _, form := range lst.Slice()[1:] {
+			var e error
+			if res, e = VM_EVAL(form, env); e != nil {
+				return nil, e
+			}
+		}
+		return res, nil
+	}
+	globals, ok := env.(*Env)
+	if !ok {
+		return nil, errors.New("VM_EVAL requires a global Env")
+	}
+	p, e := compile_proto(ast, globals)
+	if e != nil {
+		return nil, e
+	}
+	return vm.run(&closure{p, nil}, nil)
+}
+
+func (m *machine) push(obj MalType) {
+	m.stack = append(m.stack, obj)
+}
+
+func (m *machine) pop() MalType {
+	obj := m.stack[len(m.stack)-1]
+	m.stack = m.stack[:len(m.stack)-1]
+	return obj
+}
+
+// popn removes the top n values, returning a copy of them
+func (m *machine) popn(n int) []MalType {
+	top := len(m.stack)
+	vals := append([]MalType{}, m.stack[top-n:]...)
+	m.stack = m.stack[:top-n]
+	return vals
+}
+
+func check_arity(p *proto, n int) error {
+	if n < p.nparams || !p.variadic && n > p.nparams {
+		return arity_error(n, p.name)
+	}
+	return nil
+}
+
+// enter starts a frame for cl with its n arguments on top of the stack
+func (m *machine) enter(cl *closure, n int) {
+	p := cl.p
+	base := len(m.stack) - n
+	if p.variadic {
+		rest := List{Val: append([]MalType{}, m.stack[base+p.nparams:]...)}
+		m.stack = append(m.stack[:base+p.nparams], rest)
+	} else {
+		m.stack = m.stack[:base+p.nparams]
+	}
+	for len(m.stack) < base+p.nlocals {
+		m.stack = append(m.stack, nil)
+	}
+	m.frames = append(m.frames, call_frame{cl, 0, base, p.nlocals})
+}
+
+// call calls the function below the top n values. With tail set and a
+// compiled function, the current frame is replaced; otherwise the
+// result is pushed, and the code following a tail call returns it.
+func (m *machine) call(n int, tail bool) error {
+	top := len(m.stack)
+	fn := m.stack[top-n-1]
+	if f, ok := fn.(*MalFunc); ok {
+		cl, ok := f.Env.(*closure)
+		if a, multi := f.Env.(*arities); multi {
+			if cl, ok = a.pick(n), true; cl == nil {
+				return arity_error(n, a.p.name)
+			}
+		}
+		if ok {
+			if e := check_arity(cl.p, n); e != nil {
+				return e
+			}
+			if tail {
+				fr := m.frames[len(m.frames)-1]
+				copy(m.stack[fr.base-1:], m.stack[top-n-1:])
+				m.stack = m.stack[:fr.base+n]
+				m.frames = m.frames[:len(m.frames)-1]
+			}
+			m.enter(cl, n)
+			return nil
+		}
+	}
+	args := m.popn(n)
+	m.pop()
+	var res MalType
+	var e error
+	switch f := fn.(type) {
+	case *Func:
+		res, e = call_builtin(f, args)
+	case *MalFunc:
+		res, e = Apply(f, args)
+	case IFn:
+		res, e = f.Invoke(args)
+	default:
+		e = NewError("type", "attempt to call non-function")
+	}
+	if e != nil {
+		return e
+	}
+	m.push(res)
+	return nil
+}
+
+// expand continues the current frame with the code compiled for site s
+// (see vm_site.compile)
+func (m *machine) expand(s *vm_site, mac *MalFunc) error {
+	ip, e := s.compile(mac, m.frames[len(m.frames)-1].ip)
+	if e != nil {
+		return e
+	}
+	// the macro ran on this machine, which may have moved the frames
+	fr := &m.frames[len(m.frames)-1]
+	m.grow(fr)
+	fr.ip = ip
+	return nil
+}
+
+// grow makes room in the current frame for the locals added to its
+// proto since it was entered, moving up the values above the locals
+func (m *machine) grow(fr *call_frame) {
+	n := fr.cl.p.nlocals - fr.nlocals
+	if n == 0 {
+		return
+	}
+	at := fr.base + fr.nlocals
+	m.stack = append(m.stack, make([]MalType, n)...)
+	copy(m.stack[at+n:], m.stack[at:len(m.stack)-n])
+	clear(m.stack[at : at+n])
+	fr.nlocals += n
+}
+
+// unwind looks for a handler for e, from the current frame out to the
+// frame run started with. Each frame is added to the stack trace of e,
+// with the call it was making, unless rethrown says e is an exception
+// raised again from the current one, which already has its entry.
+func (m *machine) unwind(e error, entry int, rethrown bool) error {
+	for len(m.frames) > entry {
+		fr := &m.frames[len(m.frames)-1]
+		if c := fr.cl.p.call_at(fr.ip); !rethrown && c != nil && c.form != nil {
+			e = AddTrace(e, TraceFrame{fr.cl.p.name, c.form, c.pos})
+		}
+		rethrown = false
+		for _, h := range fr.cl.p.handlers {
+			if h.start < fr.ip && fr.ip <= h.end {
+				m.stack = m.stack[:fr.base+fr.nlocals+h.depth]
+				m.push(&caught{e})
+				fr.ip = h.target
+				return nil
+			}
+		}
+		m.stack = m.stack[:fr.base-1]
+		m.frames = m.frames[:len(m.frames)-1]
+	}
+	return e
+}
+
+func (m *machine) run(cl *closure, args []MalType) (MalType, error) {
+	if e := check_arity(cl.p, len(args)); e != nil {
+		return nil, e
+	}
+	entry, top := len(m.frames), len(m.stack)
+	defer func() {
+		// a panic recovered by Apply must not leave our frames behind
+		if r := recover(); r != nil {
+			m.frames, m.stack = m.frames[:entry], m.stack[:top]
+			panic(r)
+		}
+	}()
+	m.push(nil) // in place of the function
+	m.stack = append(m.stack, args...)
+	m.enter(cl, len(args))
+	for {
+		fr := &m.frames[len(m.frames)-1]
+		p := fr.cl.p
+		op := p.code[fr.ip]
+		arg := 0
+		if has_operand(op) {
+			arg = int(p.code[fr.ip+1])<<8 | int(p.code[fr.ip+2])
+			fr.ip += 3
+		} else {
+			fr.ip += 1
+		}
+		var e error
+		switch op {
+		case OP_CONST:
+			m.push(p.consts[arg])
+		case OP_GET_LOCAL:
+			m.push(m.stack[fr.base+arg])
+		case OP_SET_LOCAL:
+			m.stack[fr.base+arg] = m.pop()
+		case OP_INIT_LOCAL, OP_INIT_PARAM:
+		case OP_GET_CELL:
+			m.push(m.stack[fr.base+arg].(*cell).val)
+		case OP_SET_CELL:
+			m.stack[fr.base+arg].(*cell).val = m.pop()
+		case OP_NEW_CELL:
+			m.stack[fr.base+arg] = &cell{}
+		case OP_BOX:
+			m.stack[fr.base+arg] = &cell{m.stack[fr.base+arg]}
+		case OP_GET_UPVAL:
+			m.push(fr.cl.upvals[arg].val)
+		case OP_GET_GLOBAL:
+			var val MalType
+			if val, e = p.vars[arg].Get(); e == nil {
+				m.push(val)
+			}
+		case OP_DEF_GLOBAL:
+			p.vars[arg].Set(m.stack[len(m.stack)-1])
+		case OP_DEF_MACRO:
+			if fn, ok := m.stack[len(m.stack)-1].(*MalFunc); ok {
+				m.stack[len(m.stack)-1] = fn.SetMacro()
+				p.vars[arg].Set(m.stack[len(m.stack)-1])
+			} else {
+				e = errors.New("defmacro! requires a function")
+			}
+		case OP_POP:
+			m.pop()
+		case OP_JUMP:
+			fr.ip = arg
+		case OP_JUMP_IF_FALSE:
+			if cond := m.pop(); cond == nil || cond == Bool(false) {
+				fr.ip = arg
+			}
+		case OP_CALL:
+			e = m.call(arg, false)
+		case OP_TAIL_CALL:
+			e = m.call(arg, true)
+		case OP_GET_CALLEE:
+			s := p.sites[arg]
+			var val MalType
+			if val, e = s.v.Get(); e == nil {
+				if mac, ok := val.(*MalFunc); ok && mac.GetMacro() {
+					e = m.expand(s, mac)
+				} else {
+					m.push(val)
+				}
+			}
+		case OP_CHECK_CALLEE:
+			if mac, ok := m.stack[len(m.stack)-1].(*MalFunc); ok && mac.GetMacro() {
+				m.pop()
+				e = m.expand(p.sites[arg], mac)
+			}
+		case OP_EXPANDED:
+			if s := p.sites[arg]; s.v.Val != s.macro {
+				e = m.expand(s, nil)
+			}
+		case OP_RETURN:
+			res := m.pop()
+			m.stack = m.stack[:fr.base-1]
+			m.frames = m.frames[:len(m.frames)-1]
+			if len(m.frames) == entry {
+				return res, nil
+			}
+			m.push(res)
+		case OP_CLOSURE:
+			child := p.protos[arg]
+			upvals := make([]*cell, len(child.upvals))
+			for i, u := range child.upvals {
+				if u.copy {
+					upvals[i] = &cell{m.stack[fr.base+u.index]}
+				} else if u.local {
+					upvals[i] = m.stack[fr.base+u.index].(*cell)
+				} else {
+					upvals[i] = fr.cl.upvals[u.index]
+				}
+			}
+			m.push(&MalFunc{vm_eval, child.body, &closure{child, upvals}, child.params, false, vm_bind, nil})
+		case OP_ARITIES:
+			clauses := p.consts[arg].(List)
+			closures := m.popn(clauses.Count())
+			a := &arities{closures[0].(*MalFunc).Env.(*closure), make([]*closure, len(closures))}
+			for i, fn := range closures {
+				a.all[i] = fn.(*MalFunc).Env.(*closure)
+			}
+			m.push(&MalFunc{vm_eval, clauses, a, nil, false, arities_bind, nil})
+		case OP_VECTOR:
+			m.push(Vector{m.popn(arg), nil})
+		case OP_HASH_MAP:
+			m.push(HashMap{}.AssocAll(m.popn(2 * arg)...))
+		case OP_FAIL:
+			e = p.errs[arg]
+		case OP_CATCHES:
+			m.push(Bool(catches(p.consts[arg], exception(m.stack[len(m.stack)-1].(*caught).err))))
+		case OP_CAUGHT:
+			m.stack[len(m.stack)-1] = exception(m.stack[len(m.stack)-1].(*caught).err)
+		case OP_RETHROW:
+			e = m.pop().(*caught).err
+		default:
+			e = fmt.Errorf("invalid opcode %d", op)
+		}
+		if e != nil {
+			if e = m.unwind(e, entry, op == OP_RETHROW); e != nil {
+				return nil, e
+			}
+		}
+	}
+}
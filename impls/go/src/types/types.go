@@ -3,8 +3,13 @@ package types
 import (
 	"errors"
 	"fmt"
-	"reflect"
+	"hash/fnv"
+	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"unicode/utf8"
 )
 
 // Errors/Exceptions
@@ -13,11 +18,223 @@ type MalError struct {
 }
 
 func (e MalError) Error() string {
-	return fmt.Sprintf("%#v", e.Obj)
+	if ex, ok := e.Obj.(*ExInfo); ok {
+		return ex.Message
+	}
+	return pr_str(e.Obj)
+}
+
+// ExInfo is an exception made by ex-info: a message, a map of data and
+// the exception that caused it. It prints as #error {:message ...
+// :data ...}, but one made for an internal error prints as its message,
+// as errors do in mal.
+type ExInfo struct {
+	Message  string
+	Data     HashMap
+	Cause    MalType
+	internal bool
+}
+
+func (ex *ExInfo) Type() string           { return "ex-info" }
+func (ex *ExInfo) Equal(obj MalType) bool { return obj == MalType(ex) }
+func (ex *ExInfo) Hash() uint32           { return hash_string(ex.Message) }
+func (ex *ExInfo) Internal() bool         { return ex.internal }
+func (ex *ExInfo) String() string {
+	if ex.internal {
+		return String(ex.Message).String()
+	}
+	str := "#error {:message " + String(ex.Message).String() + " :data " + ex.Data.String()
+	if ex.Cause != nil {
+		str += " :cause " + ex.Cause.String()
+	}
+	return str + "}"
+}
+
+// the data of an ex-info can be read as if it was the ex-info
+func (ex *ExInfo) ValAt(key MalType) (MalType, bool) {
+	return ex.Data.ValAt(key)
+}
+
+func ExInfo_Q(obj MalType) bool {
+	_, ok := obj.(*ExInfo)
+	return ok
+}
+
+// ErrorInfo makes the ex-info catch* gets for an internal failure, with
+// the keyword typ as its :type
+func ErrorInfo(typ string, msg string) *ExInfo {
+	return &ExInfo{msg, HashMap{}.AssocAll(Keyword("type"), Keyword(typ)), nil, true}
+}
+
+// NewError makes the error for an internal failure
+func NewError(typ string, msg string) error {
+	return MalError{ErrorInfo(typ, msg)}
+}
+
+// Recover is deferred around calls into Go code that may panic on bad
+// arguments, such as an unchecked type assertion or an integer division
+// by zero. It turns the panic into a MalError naming fn, the function
+// called, stored in *e.
+func Recover(fn string, args []MalType, e *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	var typ, msg string
+	switch r := r.(type) {
+	case *runtime.TypeAssertionError:
+		types := make([]string, len(args))
+		for i, a := range args {
+			types[i] = TypeOf(a)
+		}
+		typ, msg = "type", "unsupported argument types ("+strings.Join(types, ", ")+")"
+	case error:
+		typ, msg = "runtime", strings.TrimPrefix(r.Error(), "runtime error: ")
+	default:
+		typ, msg = "runtime", fmt.Sprint(r)
+	}
+	*e = NewError(typ, fn+": "+msg)
+}
+
+// TracedError is an error with the stack trace of the mal calls it
+// went through on its way out, innermost first
+type TracedError struct {
+	Err   error
+	Trace []TraceFrame
+}
+
+func (e *TracedError) Error() string {
+	return e.Err.Error()
+}
+
+// TraceFrame is an entry of a stack trace: a function, and the call in
+// it that was running when the error happened
+type TraceFrame struct {
+	Fn   string // "" at the top level
+	Form MalType
+	Pos  *Pos
+}
+
+func (fr TraceFrame) String() string {
+	fn := fr.Fn
+	if fn == "" {
+		fn = "<top level>"
+	}
+	if fr.Pos != nil {
+		fn += " (" + fr.Pos.String() + ")"
+	}
+	form := pr_str(fr.Form)
+	if len(form) > 60 {
+		form = form[:57] + "..."
+	}
+	return "at " + fn + ": " + form
+}
+
+// AddTrace returns e with fr added to its stack trace
+func AddTrace(e error, fr TraceFrame) error {
+	if te, ok := e.(*TracedError); ok {
+		te.Trace = append(te.Trace, fr)
+		return te
+	}
+	return &TracedError{e, []TraceFrame{fr}}
+}
+
+// Untraced returns the error e carries a stack trace for
+func Untraced(e error) error {
+	if te, ok := e.(*TracedError); ok {
+		return te.Err
+	}
+	return e
+}
+
+// Pos is where the reader found a form
+type Pos struct {
+	Source string // the file name, or "" for a string
+	Line   int
+	Col    int
+}
+
+func (p *Pos) String() string {
+	pos := strconv.Itoa(p.Line) + ":" + strconv.Itoa(p.Col)
+	if p.Source != "" {
+		pos = p.Source + ":" + pos
+	}
+	return pos
 }
 
 // General types
+
+// MalType is implemented by every mal value except nil, which is
+// represented by a nil MalType. String returns the readable printed
+// form of the value.
 type MalType interface {
+	Type() string
+	Equal(MalType) bool
+	Hash() uint32
+	String() string
+}
+
+// Collection interfaces. Core functions are written against these
+// rather than concrete types, so any type implementing them works with
+// count, nth, get, seq and friends.
+
+// Seqable values can be walked as a list of their elements. Seq returns
+// nil when there are no elements.
+type Seqable interface {
+	Seq() MalType
+}
+
+type Counted interface {
+	Count() int
+}
+
+// Indexed values give positional access; ok is false when the index is
+// out of range
+type Indexed interface {
+	Counted
+	Nth(idx int) (value MalType, ok bool)
+}
+
+// ILookup values can be looked up by key; found is false when the key
+// is missing
+type ILookup interface {
+	ValAt(key MalType) (value MalType, found bool)
+}
+
+// Associative values can be updated by key, returning a new value
+type Associative interface {
+	ILookup
+	ContainsKey(key MalType) bool
+	Assoc(key MalType, value MalType) (MalType, error)
+}
+
+// IFn values can be called like functions: keywords, maps and vectors
+// look their argument up
+type IFn interface {
+	Invoke(args []MalType) (MalType, error)
+}
+
+func IFn_Q(obj MalType) bool {
+	_, ok := obj.(IFn)
+	return ok
+}
+
+// invoke_lookup is the Invoke of lookups, (coll key) or (coll key
+// default)
+func invoke_lookup(coll MalType, key MalType, args []MalType) (MalType, error) {
+	if l, ok := coll.(ILookup); ok {
+		if v, found := l.ValAt(key); found {
+			return v, nil
+		}
+	}
+	if len(args) > 0 {
+		return args[0], nil
+	}
+	return nil, nil
+}
+
+func invoke_arity(name string, n int) error {
+	return NewError("arity", fmt.Sprintf("wrong number of args (%d) passed to %s", n, name))
 }
 
 type EnvType interface {
@@ -26,29 +243,159 @@ type EnvType interface {
 	Get(key Symbol) (MalType, error)
 }
 
+// TypeOf, Equal_Q and Hash are the nil-safe entry points to the
+// MalType methods
+func TypeOf(obj MalType) string {
+	if obj == nil {
+		return "nil"
+	}
+	return obj.Type()
+}
+
+func Equal_Q(a MalType, b MalType) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Equal(b)
+}
+
+func Hash(obj MalType) uint32 {
+	if obj == nil {
+		return 0
+	}
+	return obj.Hash()
+}
+
+func hash_string(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+func pr_str(obj MalType) string {
+	if obj == nil {
+		return "nil"
+	}
+	return obj.String()
+}
+
+func pr_list(lst []MalType, start string, end string) string {
+	str_list := make([]string, 0, len(lst))
+	for _, e := range lst {
+		str_list = append(str_list, pr_str(e))
+	}
+	return start + strings.Join(str_list, " ") + end
+}
+
 // Scalars
 func Nil_Q(obj MalType) bool {
 	return obj == nil
 }
 
+type Bool bool
+
+func (b Bool) Type() string { return "boolean" }
+
+func (b Bool) Equal(obj MalType) bool {
+	ob, ok := obj.(Bool)
+	return ok && ob == b
+}
+
+func (b Bool) Hash() uint32 {
+	if b {
+		return 1231
+	}
+	return 1237
+}
+
+func (b Bool) String() string {
+	return strconv.FormatBool(bool(b))
+}
+
 func True_Q(obj MalType) bool {
-	b, ok := obj.(bool)
+	b, ok := obj.(Bool)
 	return ok && b == true
 }
 
 func False_Q(obj MalType) bool {
-	b, ok := obj.(bool)
+	b, ok := obj.(Bool)
 	return ok && b == false
 }
 
+type Int int
+
+func (i Int) Type() string { return "number" }
+
+func (i Int) Equal(obj MalType) bool {
+	oi, ok := obj.(Int)
+	return ok && oi == i
+}
+
+func (i Int) Hash() uint32 {
+	return uint32(i) ^ uint32(uint64(i)>>32)
+}
+
+func (i Int) String() string {
+	return strconv.Itoa(int(i))
+}
+
 func Number_Q(obj MalType) bool {
-	_, ok := obj.(int)
+	_, ok := obj.(Int)
 	return ok
 }
 
-// Symbols
+// Symbols are interned: all the Symbols with one name share a single
+// *SymbolName, so that they compare by pointer, and environments can
+// key on the Id. Make them with NewSymbol.
+type SymbolName struct {
+	Val  string
+	Id   uint32
+	hash uint32
+}
+
 type Symbol struct {
-	Val string
+	*SymbolName
+	Meta MalType
+}
+
+var symbols = struct {
+	sync.Mutex
+	names map[string]*SymbolName
+	ids   []*SymbolName // by Id, from 1
+}{names: map[string]*SymbolName{}, ids: []*SymbolName{nil}}
+
+func NewSymbol(name string) Symbol {
+	symbols.Lock()
+	defer symbols.Unlock()
+	sn, ok := symbols.names[name]
+	if !ok {
+		sn = &SymbolName{name, uint32(len(symbols.names)) + 1, hash_string(name) * 31}
+		symbols.names[name] = sn
+		symbols.ids = append(symbols.ids, sn)
+	}
+	return Symbol{sn, nil}
+}
+
+// SymbolById gives the symbol with an Id made by NewSymbol
+func SymbolById(id uint32) Symbol {
+	symbols.Lock()
+	defer symbols.Unlock()
+	return Symbol{symbols.ids[id], nil}
+}
+
+func (s Symbol) Type() string { return "symbol" }
+
+func (s Symbol) Equal(obj MalType) bool {
+	os, ok := obj.(Symbol)
+	return ok && os.SymbolName == s.SymbolName
+}
+
+func (s Symbol) Hash() uint32 {
+	return s.hash
+}
+
+func (s Symbol) String() string {
+	return s.Val
 }
 
 func Symbol_Q(obj MalType) bool {
@@ -57,18 +404,138 @@ func Symbol_Q(obj MalType) bool {
 }
 
 // Keywords
+type Keyword string
+
+func (k Keyword) Type() string { return "keyword" }
+
+func (k Keyword) Equal(obj MalType) bool {
+	ok_kw, ok := obj.(Keyword)
+	return ok && ok_kw == k
+}
+
+func (k Keyword) Hash() uint32 {
+	return hash_string(string(k)) * 37
+}
+
+func (k Keyword) String() string {
+	return ":" + string(k)
+}
+
+// Invoke looks the keyword up in a map, (:k m) or (:k m default)
+func (k Keyword) Invoke(args []MalType) (MalType, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, invoke_arity(k.String(), len(args))
+	}
+	return invoke_lookup(args[0], k, args[1:])
+}
+
 func NewKeyword(s string) (MalType, error) {
-	return "\u029e" + s, nil
+	return Keyword(s), nil
 }
 
 func Keyword_Q(obj MalType) bool {
-	s, ok := obj.(string)
-	return ok && strings.HasPrefix(s, "\u029e")
+	_, ok := obj.(Keyword)
+	return ok
 }
 
 // Strings
+type String string
+
+func (s String) Type() string { return "string" }
+
+func (s String) Equal(obj MalType) bool {
+	os, ok := obj.(String)
+	return ok && os == s
+}
+
+func (s String) Hash() uint32 {
+	return hash_string(string(s))
+}
+
+func (s String) String() string {
+	return `"` + strings.Replace(
+		strings.Replace(
+			strings.Replace(string(s), `\`, `\\`, -1),
+			`"`, `\"`, -1),
+		"\n", `\n`, -1) + `"`
+}
+
+func (s String) Seq() MalType {
+	if len(s) == 0 {
+		return nil
+	}
+	slc := []MalType{}
+	for _, ch := range string(s) {
+		slc = append(slc, String(ch))
+	}
+	return List{Val: slc}
+}
+
+func (s String) Count() int {
+	return utf8.RuneCountInString(string(s))
+}
+
+func (s String) Nth(idx int) (MalType, bool) {
+	if idx < 0 {
+		return nil, false
+	}
+	for _, ch := range string(s) {
+		if idx == 0 {
+			return String(ch), true
+		}
+		idx -= 1
+	}
+	return nil, false
+}
+
+func (s String) ValAt(key MalType) (MalType, bool) {
+	if idx, ok := key.(Int); ok {
+		return s.Nth(int(idx))
+	}
+	return nil, false
+}
+
 func String_Q(obj MalType) bool {
-	_, ok := obj.(string)
+	_, ok := obj.(String)
+	return ok
+}
+
+// Regular expressions
+type Regex struct {
+	Val *regexp.Regexp
+	// Val anchored at both ends, used for whole-string matching
+	Anchored *regexp.Regexp
+}
+
+func NewRegex(pattern string) (MalType, error) {
+	re, e := regexp.Compile(pattern)
+	if e != nil {
+		return nil, e
+	}
+	anchored, e := regexp.Compile(`^(?:` + pattern + `)$`)
+	if e != nil {
+		return nil, e
+	}
+	return Regex{re, anchored}, nil
+}
+
+func (r Regex) Type() string { return "regex" }
+
+func (r Regex) Equal(obj MalType) bool {
+	or, ok := obj.(Regex)
+	return ok && or.Val == r.Val
+}
+
+func (r Regex) Hash() uint32 {
+	return hash_string(r.Val.String())
+}
+
+func (r Regex) String() string {
+	return `#"` + strings.Replace(r.Val.String(), `"`, `\"`, -1) + `"`
+}
+
+func Regex_Q(obj MalType) bool {
+	_, ok := obj.(Regex)
 	return ok
 }
 
@@ -78,8 +545,23 @@ type Func struct {
 	Meta MalType
 }
 
+func (f *Func) Type() string { return "function" }
+
+func (f *Func) Equal(obj MalType) bool {
+	of, ok := obj.(*Func)
+	return ok && of == f
+}
+
+func (f *Func) Hash() uint32 {
+	return hash_string("function")
+}
+
+func (f *Func) String() string {
+	return "#<function>"
+}
+
 func Func_Q(obj MalType) bool {
-	_, ok := obj.(Func)
+	_, ok := obj.(*Func)
 	return ok
 }
 
@@ -93,47 +575,151 @@ type MalFunc struct {
 	Meta    MalType
 }
 
+func (f *MalFunc) Type() string {
+	if f.IsMacro {
+		return "macro"
+	}
+	return "function"
+}
+
+func (f *MalFunc) Equal(obj MalType) bool {
+	of, ok := obj.(*MalFunc)
+	return ok && of == f
+}
+
+func (f *MalFunc) Hash() uint32 {
+	return hash_string("function")
+}
+
+func (f *MalFunc) String() string {
+	// a function with several arities has its (params body) clauses
+	// in Exp instead
+	if clauses, ok := f.Exp.(List); ok && f.Params == nil {
+		return pr_list(clauses.Slice(), "(fn* ", ")")
+	}
+	return "(fn* " + pr_str(f.Params) + " " + pr_str(f.Exp) + ")"
+}
+
 func MalFunc_Q(obj MalType) bool {
-	_, ok := obj.(MalFunc)
+	_, ok := obj.(*MalFunc)
 	return ok
 }
 
-func (f MalFunc) SetMacro() MalType {
-	f.IsMacro = true
-	return f
+func (f *MalFunc) SetMacro() MalType {
+	mac := *f
+	mac.IsMacro = true
+	return &mac
 }
 
-func (f MalFunc) GetMacro() bool {
+func (f *MalFunc) GetMacro() bool {
 	return f.IsMacro
 }
 
 // Take either a MalFunc or regular function and apply it to the
-// arguments
-func Apply(f_mt MalType, a []MalType) (MalType, error) {
+// arguments. A panic in Go code on the way is returned as an error.
+func Apply(f_mt MalType, a []MalType) (res MalType, err error) {
+	defer Recover(TypeOf(f_mt), a, &err)
 	switch f := f_mt.(type) {
-	case MalFunc:
-		env, e := f.GenEnv(f.Env, f.Params, List{a, nil})
+	case *MalFunc:
+		env, e := f.GenEnv(f.Env, f.Params, List{Val: a})
 		if e != nil {
 			return nil, e
 		}
 		return f.Eval(f.Exp, env)
-	case Func:
+	case *Func:
 		return f.Fn(a)
-	case func([]MalType) (MalType, error):
-		return f(a)
+	case IFn:
+		return f.Invoke(a)
 	default:
 		return nil, errors.New("Invalid function to Apply")
 	}
 }
 
-// Lists
+// Lists are persistent: Val holds the first elements, and a list made
+// by Cons or Rest has the others in the list it shares as its tail, so
+// both take O(1). Lists read or built at once are a plain slice; code
+// that takes a list whole uses Slice.
 type List struct {
 	Val  []MalType
 	Meta MalType
+	Pos  *Pos // set by the reader
+	tail *List
+	more int // the count of tail
 }
 
 func NewList(a ...MalType) MalType {
-	return List{a, nil}
+	return List{Val: a}
+}
+
+// Cons returns a list of x followed by the elements of l
+func (l List) Cons(x MalType) List {
+	if l.Count() == 0 {
+		return List{Val: []MalType{x}}
+	}
+	l.Meta, l.Pos = nil, nil
+	return List{Val: []MalType{x}, tail: &l, more: l.Count()}
+}
+
+// Rest returns the list of the elements of l after the first one
+func (l List) Rest() List {
+	switch {
+	case len(l.Val) > 1:
+		return List{Val: l.Val[1:], tail: l.tail, more: l.more}
+	case l.tail != nil:
+		return *l.tail
+	default:
+		return List{}
+	}
+}
+
+// Slice gives the elements of l, which are only copied into a new slice
+// when l has a tail
+func (l List) Slice() []MalType {
+	if l.tail == nil {
+		return l.Val
+	}
+	slc := make([]MalType, 0, l.Count())
+	for t := &l; t != nil; t = t.tail {
+		slc = append(slc, t.Val...)
+	}
+	return slc
+}
+
+func (l List) Seq() MalType {
+	if l.Count() == 0 {
+		return nil
+	}
+	return l
+}
+
+func (l List) Count() int {
+	return len(l.Val) + l.more
+}
+
+func (l List) Nth(idx int) (MalType, bool) {
+	if idx < 0 || idx >= l.Count() {
+		return nil, false
+	}
+	t := &l
+	for idx >= len(t.Val) {
+		idx -= len(t.Val)
+		t = t.tail
+	}
+	return t.Val[idx], true
+}
+
+func (l List) Type() string { return "list" }
+
+func (l List) Equal(obj MalType) bool {
+	return equal_sequential(l.Slice(), obj)
+}
+
+func (l List) Hash() uint32 {
+	return hash_sequential(l.Slice())
+}
+
+func (l List) String() string {
+	return pr_list(l.Slice(), "(", ")")
 }
 
 func List_Q(obj MalType) bool {
@@ -147,6 +733,85 @@ type Vector struct {
 	Meta MalType
 }
 
+func (v Vector) Seq() MalType {
+	if len(v.Val) == 0 {
+		return nil
+	}
+	return List{Val: v.Val}
+}
+
+func (v Vector) Count() int {
+	return len(v.Val)
+}
+
+func (v Vector) Nth(idx int) (MalType, bool) {
+	if idx < 0 || idx >= len(v.Val) {
+		return nil, false
+	}
+	return v.Val[idx], true
+}
+
+func (v Vector) ValAt(key MalType) (MalType, bool) {
+	if idx, ok := key.(Int); ok {
+		return v.Nth(int(idx))
+	}
+	return nil, false
+}
+
+// Invoke gives the element at an index, like nth
+func (v Vector) Invoke(args []MalType) (MalType, error) {
+	if len(args) != 1 {
+		return nil, invoke_arity("vector", len(args))
+	}
+	idx, ok := args[0].(Int)
+	if !ok {
+		return nil, errors.New("vector index must be an integer")
+	}
+	if val, ok := v.Nth(int(idx)); ok {
+		return val, nil
+	}
+	return nil, errors.New("vector index out of range")
+}
+
+func (v Vector) ContainsKey(key MalType) bool {
+	_, found := v.ValAt(key)
+	return found
+}
+
+// Assoc replaces the element at an index, or appends when the index is
+// one past the end
+func (v Vector) Assoc(key MalType, value MalType) (MalType, error) {
+	idx, ok := key.(Int)
+	if !ok {
+		return nil, errors.New("vector index must be an integer")
+	}
+	if idx < 0 || int(idx) > len(v.Val) {
+		return nil, errors.New("vector index out of range")
+	}
+	slc := make([]MalType, len(v.Val), len(v.Val)+1)
+	copy(slc, v.Val)
+	if int(idx) == len(v.Val) {
+		slc = append(slc, value)
+	} else {
+		slc[idx] = value
+	}
+	return Vector{slc, v.Meta}, nil
+}
+
+func (v Vector) Type() string { return "vector" }
+
+func (v Vector) Equal(obj MalType) bool {
+	return equal_sequential(v.Val, obj)
+}
+
+func (v Vector) Hash() uint32 {
+	return hash_sequential(v.Val)
+}
+
+func (v Vector) String() string {
+	return pr_list(v.Val, "[", "]")
+}
+
 func Vector_Q(obj MalType) bool {
 	_, ok := obj.(Vector)
 	return ok
@@ -155,18 +820,59 @@ func Vector_Q(obj MalType) bool {
 func GetSlice(seq MalType) ([]MalType, error) {
 	switch obj := seq.(type) {
 	case List:
-		return obj.Val, nil
+		return obj.Slice(), nil
 	case Vector:
 		return obj.Val, nil
+	case Seqable:
+		if s := obj.Seq(); s != nil {
+			return s.(List).Slice(), nil
+		}
+		return []MalType{}, nil
 	default:
 		return nil, errors.New("GetSlice called on non-sequence")
 	}
 }
 
+// lists and vectors with the same elements are equal, and so must hash
+// the same
+func equal_sequential(as []MalType, b MalType) bool {
+	if !Sequential_Q(b) {
+		return false
+	}
+	bs, _ := GetSlice(b)
+	if len(as) != len(bs) {
+		return false
+	}
+	for i := 0; i < len(as); i += 1 {
+		if !Equal_Q(as[i], bs[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func hash_sequential(lst []MalType) uint32 {
+	h := uint32(1)
+	for _, x := range lst {
+		h = 31*h + Hash(x)
+	}
+	return h
+}
+
 // Hash Maps
+
+// HashMap entries are bucketed by key hash and compared with Equal
+// within a bucket, so any value can be used as a key. The zero value is
+// an empty map.
+type MapEntry struct {
+	Key   MalType
+	Value MalType
+}
+
 type HashMap struct {
-	Val  map[string]MalType
-	Meta MalType
+	buckets map[uint32][]MapEntry
+	size    int
+	Meta    MalType
 }
 
 func NewHashMap(seq MalType) (MalType, error) {
@@ -177,15 +883,190 @@ func NewHashMap(seq MalType) (MalType, error) {
 	if len(lst)%2 == 1 {
 		return nil, errors.New("Odd number of arguments to NewHashMap")
 	}
-	m := map[string]MalType{}
+	hm := HashMap{}
 	for i := 0; i < len(lst); i += 2 {
-		str, ok := lst[i].(string)
-		if !ok {
-			return nil, errors.New("expected hash-map key string")
+		hm.set(lst[i], lst[i+1])
+	}
+	return hm, nil
+}
+
+func (hm HashMap) clone() HashMap {
+	buckets := make(map[uint32][]MapEntry, len(hm.buckets))
+	for h, bucket := range hm.buckets {
+		buckets[h] = bucket
+	}
+	return HashMap{buckets, hm.size, hm.Meta}
+}
+
+// set and remove modify the map in place, so they are only used on
+// maps that have not been handed out yet (or on transients). Buckets
+// may be shared with other maps and are copied rather than written.
+func (hm *HashMap) set(key MalType, value MalType) {
+	if hm.buckets == nil {
+		hm.buckets = map[uint32][]MapEntry{}
+	}
+	h := Hash(key)
+	bucket := hm.buckets[h]
+	for i, entry := range bucket {
+		if Equal_Q(entry.Key, key) {
+			new_bucket := make([]MapEntry, len(bucket))
+			copy(new_bucket, bucket)
+			new_bucket[i] = MapEntry{key, value}
+			hm.buckets[h] = new_bucket
+			return
+		}
+	}
+	new_bucket := make([]MapEntry, len(bucket), len(bucket)+1)
+	copy(new_bucket, bucket)
+	hm.buckets[h] = append(new_bucket, MapEntry{key, value})
+	hm.size += 1
+}
+
+func (hm *HashMap) remove(key MalType) {
+	h := Hash(key)
+	bucket := hm.buckets[h]
+	for i, entry := range bucket {
+		if Equal_Q(entry.Key, key) {
+			if len(bucket) == 1 {
+				delete(hm.buckets, h)
+			} else {
+				new_bucket := make([]MapEntry, 0, len(bucket)-1)
+				new_bucket = append(new_bucket, bucket[:i]...)
+				hm.buckets[h] = append(new_bucket, bucket[i+1:]...)
+			}
+			hm.size -= 1
+			return
+		}
+	}
+}
+
+func (hm HashMap) ValAt(key MalType) (MalType, bool) {
+	for _, entry := range hm.buckets[Hash(key)] {
+		if Equal_Q(entry.Key, key) {
+			return entry.Value, true
+		}
+	}
+	return nil, false
+}
+
+func (hm HashMap) Count() int {
+	return hm.size
+}
+
+func (hm HashMap) Entries() []MapEntry {
+	entries := make([]MapEntry, 0, hm.size)
+	for _, bucket := range hm.buckets {
+		entries = append(entries, bucket...)
+	}
+	return entries
+}
+
+func (hm HashMap) Keys() []MalType {
+	keys := make([]MalType, 0, hm.size)
+	for _, bucket := range hm.buckets {
+		for _, entry := range bucket {
+			keys = append(keys, entry.Key)
 		}
-		m[str] = lst[i+1]
 	}
-	return HashMap{m, nil}, nil
+	return keys
+}
+
+func (hm HashMap) Vals() []MalType {
+	vals := make([]MalType, 0, hm.size)
+	for _, bucket := range hm.buckets {
+		for _, entry := range bucket {
+			vals = append(vals, entry.Value)
+		}
+	}
+	return vals
+}
+
+// Invoke looks a key up, (m key) or (m key default)
+func (hm HashMap) Invoke(args []MalType) (MalType, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, invoke_arity("map", len(args))
+	}
+	return invoke_lookup(hm, args[0], args[1:])
+}
+
+func (hm HashMap) ContainsKey(key MalType) bool {
+	_, found := hm.ValAt(key)
+	return found
+}
+
+func (hm HashMap) Assoc(key MalType, value MalType) (MalType, error) {
+	return hm.AssocAll(key, value), nil
+}
+
+// Seq returns the entries as a list of [key value] vectors
+func (hm HashMap) Seq() MalType {
+	if hm.size == 0 {
+		return nil
+	}
+	slc := make([]MalType, 0, hm.size)
+	for _, bucket := range hm.buckets {
+		for _, entry := range bucket {
+			slc = append(slc, Vector{[]MalType{entry.Key, entry.Value}, nil})
+		}
+	}
+	return List{Val: slc}
+}
+
+// AssocAll returns a copy of the map with key/value pairs added
+func (hm HashMap) AssocAll(kvs ...MalType) HashMap {
+	new_hm := hm.clone()
+	for i := 0; i+1 < len(kvs); i += 2 {
+		new_hm.set(kvs[i], kvs[i+1])
+	}
+	return new_hm
+}
+
+// Dissoc returns a copy of the map without the given keys
+func (hm HashMap) Dissoc(keys ...MalType) HashMap {
+	new_hm := hm.clone()
+	for _, key := range keys {
+		new_hm.remove(key)
+	}
+	return new_hm
+}
+
+func (hm HashMap) Type() string { return "map" }
+
+func (hm HashMap) Equal(obj MalType) bool {
+	ohm, ok := obj.(HashMap)
+	if !ok || hm.size != ohm.size {
+		return false
+	}
+	for _, bucket := range hm.buckets {
+		for _, entry := range bucket {
+			v, found := ohm.ValAt(entry.Key)
+			if !found || !Equal_Q(entry.Value, v) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (hm HashMap) Hash() uint32 {
+	// order independent, entries are visited in map order
+	h := uint32(0)
+	for _, bucket := range hm.buckets {
+		for _, entry := range bucket {
+			h += Hash(entry.Key) ^ (31 * Hash(entry.Value))
+		}
+	}
+	return h
+}
+
+func (hm HashMap) String() string {
+	str_list := make([]string, 0, hm.size*2)
+	for _, bucket := range hm.buckets {
+		for _, entry := range bucket {
+			str_list = append(str_list, pr_str(entry.Key), pr_str(entry.Value))
+		}
+	}
+	return "{" + strings.Join(str_list, " ") + "}"
 }
 
 func HashMap_Q(obj MalType) bool {
@@ -193,12 +1074,123 @@ func HashMap_Q(obj MalType) bool {
 	return ok
 }
 
+// Transients are mutable, single-owner builders for vectors and hash
+// maps. persistent! hands the backing store over to an immutable value
+// and disables the transient, so it must not be used afterwards.
+type TransientVector struct {
+	Val      []MalType
+	Editable bool
+}
+
+func (t *TransientVector) Type() string { return "transient" }
+
+func (t *TransientVector) Equal(obj MalType) bool {
+	ot, ok := obj.(*TransientVector)
+	return ok && ot == t
+}
+
+func (t *TransientVector) Hash() uint32 {
+	return hash_string("transient")
+}
+
+func (t *TransientVector) String() string {
+	return "#<transient " + pr_list(t.Val, "[", "]") + ">"
+}
+
+func TransientVector_Q(obj MalType) bool {
+	_, ok := obj.(*TransientVector)
+	return ok
+}
+
+func (t *TransientVector) Count() int {
+	return len(t.Val)
+}
+
+func (t *TransientVector) Nth(idx int) (MalType, bool) {
+	return Vector{t.Val, nil}.Nth(idx)
+}
+
+func (t *TransientVector) ValAt(key MalType) (MalType, bool) {
+	return Vector{t.Val, nil}.ValAt(key)
+}
+
+func (t *TransientVector) Persistent() MalType {
+	t.Editable = false
+	// cap the slice so appends on the result never share storage
+	return Vector{t.Val[:len(t.Val):len(t.Val)], nil}
+}
+
+type TransientHashMap struct {
+	Val      HashMap
+	Editable bool
+}
+
+func (t *TransientHashMap) Type() string { return "transient" }
+
+func (t *TransientHashMap) Equal(obj MalType) bool {
+	ot, ok := obj.(*TransientHashMap)
+	return ok && ot == t
+}
+
+func (t *TransientHashMap) Hash() uint32 {
+	return hash_string("transient")
+}
+
+func (t *TransientHashMap) String() string {
+	return "#<transient " + t.Val.String() + ">"
+}
+
+func TransientHashMap_Q(obj MalType) bool {
+	_, ok := obj.(*TransientHashMap)
+	return ok
+}
+
+func NewTransientHashMap(hm HashMap) *TransientHashMap {
+	return &TransientHashMap{hm.clone(), true}
+}
+
+func (t *TransientHashMap) Count() int {
+	return t.Val.Count()
+}
+
+func (t *TransientHashMap) ValAt(key MalType) (MalType, bool) {
+	return t.Val.ValAt(key)
+}
+
+func (t *TransientHashMap) Assoc(key MalType, value MalType) {
+	t.Val.set(key, value)
+}
+
+func (t *TransientHashMap) Dissoc(key MalType) {
+	t.Val.remove(key)
+}
+
+func (t *TransientHashMap) Persistent() MalType {
+	t.Editable = false
+	return t.Val
+}
+
 // Atoms
 type Atom struct {
 	Val  MalType
 	Meta MalType
 }
 
+func (a *Atom) Type() string { return "atom" }
+
+func (a *Atom) Equal(obj MalType) bool {
+	oa, ok := obj.(*Atom)
+	return ok && oa == a
+}
+
+func (a *Atom) Hash() uint32 {
+	return hash_string("atom")
+}
+
+func (a *Atom) String() string {
+	return "(atom " + pr_str(a.Val) + ")"
+}
+
 func (a *Atom) Set(val MalType) MalType {
 	a.Val = val
 	return a
@@ -209,72 +1201,61 @@ func Atom_Q(obj MalType) bool {
 	return ok
 }
 
-// General functions
-
-func _obj_type(obj MalType) string {
-	if obj == nil {
-		return "nil"
-	}
-	return reflect.TypeOf(obj).Name()
-}
-
-func Sequential_Q(seq MalType) bool {
-	if seq == nil {
-		return false
+// Metadata
+func WithMeta(obj MalType, m MalType) (MalType, error) {
+	switch tobj := obj.(type) {
+	case List:
+		tobj.Meta = m
+		return tobj, nil
+	case Vector:
+		return Vector{tobj.Val, m}, nil
+	case HashMap:
+		tobj.Meta = m
+		return tobj, nil
+	case Symbol:
+		return Symbol{tobj.SymbolName, m}, nil
+	case *Func:
+		return &Func{tobj.Fn, m}, nil
+	case *MalFunc:
+		fn := *tobj
+		fn.Meta = m
+		return &fn, nil
+	case *Atom:
+		// a copy would be a second reference diverging under swap!
+		return nil, errors.New("with-meta not supported on atoms, use alter-meta! or reset-meta!")
+	default:
+		return nil, errors.New("with-meta not supported on type")
 	}
-	return (reflect.TypeOf(seq).Name() == "List") ||
-		(reflect.TypeOf(seq).Name() == "Vector")
 }
 
-func Equal_Q(a MalType, b MalType) bool {
-	ota := reflect.TypeOf(a)
-	otb := reflect.TypeOf(b)
-	if !((ota == otb) || (Sequential_Q(a) && Sequential_Q(b))) {
-		return false
-	}
-	//av := reflect.ValueOf(a); bv := reflect.ValueOf(b)
-	//fmt.Printf("here2: %#v\n", reflect.TypeOf(a).Name())
-	//switch reflect.TypeOf(a).Name() {
-	switch a.(type) {
-	case Symbol:
-		return a.(Symbol).Val == b.(Symbol).Val
+func Meta(obj MalType) (MalType, error) {
+	switch tobj := obj.(type) {
 	case List:
-		as, _ := GetSlice(a)
-		bs, _ := GetSlice(b)
-		if len(as) != len(bs) {
-			return false
-		}
-		for i := 0; i < len(as); i += 1 {
-			if !Equal_Q(as[i], bs[i]) {
-				return false
-			}
-		}
-		return true
+		return tobj.Meta, nil
 	case Vector:
-		as, _ := GetSlice(a)
-		bs, _ := GetSlice(b)
-		if len(as) != len(bs) {
-			return false
-		}
-		for i := 0; i < len(as); i += 1 {
-			if !Equal_Q(as[i], bs[i]) {
-				return false
-			}
-		}
-		return true
+		return tobj.Meta, nil
 	case HashMap:
-		am := a.(HashMap).Val
-		bm := b.(HashMap).Val
-		if len(am) != len(bm) {
-			return false
-		}
-		for k, v := range am {
-			if !Equal_Q(v, bm[k]) {
-				return false
-			}
-		}
+		return tobj.Meta, nil
+	case Symbol:
+		return tobj.Meta, nil
+	case *Func:
+		return tobj.Meta, nil
+	case *MalFunc:
+		return tobj.Meta, nil
+	case *Atom:
+		return tobj.Meta, nil
+	default:
+		return nil, errors.New("meta not supported on type")
+	}
+}
+
+// General functions
+
+func Sequential_Q(seq MalType) bool {
+	switch seq.(type) {
+	case List, Vector:
 		return true
 	default:
-		return a == b
+		return false
 	}
 }